@@ -1,23 +1,36 @@
 package main
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // ----------------------------------------------------------------------------------------------------------------
-// Splits raw strings into blocks.
+// Splits raw strings into blocks, scanning line by line and keeping track of the block that is open.
 // ----------------------------------------------------------------------------------------------------------------
 
 type Blocks struct {
-	raw    string
-	blocks []string
+	raw     string
+	blocks  []string
+	options *Options
+
+	lines        []string
+	openType     NodeType
+	fence        *Fence
+	htmlKind     int
+	itemOffset   int
+	pendingBlank bool
+	blankBetween bool
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 // Object creation
 // ----------------------------------------------------------------------------------------------------------------
 
-func NewBlocks(rawInput *string) *Blocks {
+func NewBlocks(rawInput *string, options *Options) *Blocks {
 	blocks := &Blocks{
-		raw: *rawInput,
+		raw:     *rawInput,
+		options: options,
 	}
 	blocks.create()
 
@@ -29,7 +42,114 @@ func NewBlocks(rawInput *string) *Blocks {
 // ----------------------------------------------------------------------------------------------------------------
 
 func (b *Blocks) create() {
-	b.blocks = strings.Split(b.raw, "\n\n")
+	b.blocks = make([]string, 0)
+
+	raw := strings.ReplaceAll(b.raw, "\r\n", "\n")
+	raw = strings.ReplaceAll(raw, "\r", "\n")
+
+	for _, line := range strings.Split(raw, "\n") {
+		if b.openType != "" && b.continues(line) {
+			b.lines = append(b.lines, line)
+		} else {
+			b.closeBlock()
+			b.openBlock(line)
+		}
+
+		if b.closesAfter(line) {
+			b.closeBlock()
+		}
+	}
+
+	b.closeBlock()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Trailing blank lines are not part of the block, but they do separate it from the next one.
+func (b *Blocks) closeBlock() {
+	end := len(b.lines)
+	for end > 0 && isBlank(b.lines[end-1]) {
+		end--
+	}
+	if end < len(b.lines) {
+		b.pendingBlank = true
+	}
+
+	if end > 0 {
+		b.blocks = append(b.blocks, strings.Join(b.lines[:end], "\n"))
+	}
+
+	b.lines = nil
+	b.openType = ""
+	b.fence = nil
+	b.htmlKind = 0
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Headings and thematic breaks are a single line, fences end on their closing line and a setext underline ends the
+// paragraph above it. Most html blocks end on the line holding their closing text, which can be the first one.
+func (b *Blocks) closesAfter(line string) bool {
+	switch b.openType {
+	case CodeBlock:
+		return len(b.lines) > 1 && b.fence.isClosedBy(line)
+	case HtmlBlock:
+		return htmlBlockEnds(b.htmlKind, line)
+	case Paragraph:
+		return len(b.lines) > 1 && setextLevel(line) > 0
+	case Heading1, Heading2, Heading3, Heading4, Heading5, Heading6, ThematicBreak:
+		return true
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (b *Blocks) continues(line string) bool {
+	previous := b.lines[len(b.lines)-1]
+
+	switch b.openType {
+	case CodeBlock:
+		return true
+	case HtmlBlock:
+		return b.htmlKind < 6 || !isBlank(line)
+	case IndentedCode:
+		return isBlank(line) || leadingColumns(line) >= 4
+	case Paragraph:
+		return !isBlank(line) && (setextLevel(line) > 0 || !interruptsParagraph(line))
+	case Quote:
+		if isBlank(line) {
+			return false
+		}
+		return isQuoteLine(line) || (!isBlank(strings.TrimLeft(previous, " >")) && !interruptsParagraph(line))
+	case Footnote:
+		if isBlank(line) || leadingColumns(line) >= 4 {
+			return true
+		}
+		return !isBlank(previous) && !interruptsParagraph(line) && !b.startsFootnote(line)
+	case OrderedList, UnorderedList:
+		return b.continuesList(line, previous)
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Blank lines stay inside a list while it might carry on. Lines indented to the current item's content belong to
+// it, another marker starts the next item and unindented text directly after an item is a lazy continuation.
+func (b *Blocks) continuesList(line, previous string) bool {
+	if isBlank(line) || leadingColumns(line) >= b.itemOffset {
+		return true
+	}
+
+	if marker := listMarker(line); marker != nil {
+		b.itemOffset = marker.offset
+		return true
+	}
+
+	return !isBlank(previous) && !interruptsParagraph(line)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -39,3 +159,74 @@ func (b *Blocks) getBlocks() *[]string {
 }
 
 // ----------------------------------------------------------------------------------------------------------------
+
+// Whether any two blocks were separated by a blank line. List items with a blank line between their blocks are loose.
+func (b *Blocks) hasBlankBetween() bool {
+	return b.blankBetween
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (b *Blocks) openBlock(line string) {
+	if isBlank(line) {
+		b.pendingBlank = true
+		return
+	}
+
+	if b.pendingBlank && len(b.blocks) > 0 {
+		b.blankBetween = true
+	}
+	b.pendingBlank = false
+	b.lines = []string{line}
+
+	if b.options.IndentedCode && leadingColumns(line) >= 4 {
+		b.openType = IndentedCode
+		return
+	}
+
+	if fence := openingFence(line); fence != nil {
+		b.openType = CodeBlock
+		b.fence = fence
+		return
+	}
+
+	if kind := htmlBlockStart(line); kind > 0 {
+		b.openType = HtmlBlock
+		b.htmlKind = kind
+		return
+	}
+
+	if b.startsFootnote(line) {
+		b.openType = Footnote
+		return
+	}
+
+	if marker := listMarker(line); marker != nil {
+		b.openType = UnorderedList
+		if marker.ordered {
+			b.openType = OrderedList
+		}
+		b.itemOffset = marker.offset
+		return
+	}
+
+	switch {
+	case atxLevel(line) > 0:
+		b.openType = NodeType(fmt.Sprintf("h%v", atxLevel(line)))
+	case isThematicBreak(line):
+		b.openType = ThematicBreak
+	case isQuoteLine(line):
+		b.openType = Quote
+	default:
+		b.openType = Paragraph
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (b *Blocks) startsFootnote(line string) bool {
+	_, offset := footnoteDefinition(line)
+	return b.options.Footnotes && offset != -1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// A whole markdown file. Holds what the blocks in it share, such as the link definitions.
+// ----------------------------------------------------------------------------------------------------------------
+
+type Document struct {
+	raw         string
+	options     *Options
+	metadata    map[string]string
+	definitions map[string]*LinkDefinition
+	footnotes   map[string]*FootnoteEntry
+	used        []*FootnoteEntry
+	ids         map[string]int
+	headings    []*ParentNode
+	nodes       []HtmlNode
+}
+
+// A footnote is numbered when it is first referenced. Each reference gets a link back to it from the footnote.
+type FootnoteEntry struct {
+	number     int
+	references int
+	content    *ParentNode
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Object creation
+// ----------------------------------------------------------------------------------------------------------------
+
+func NewDocument(rawInput *string, options *Options) *Document {
+	document := &Document{
+		raw:         *rawInput,
+		options:     options,
+		definitions: make(map[string]*LinkDefinition),
+		footnotes:   make(map[string]*FootnoteEntry),
+		ids:         make(map[string]int),
+	}
+	document.parse()
+
+	return document
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Methods
+// ----------------------------------------------------------------------------------------------------------------
+
+// Front matter is taken off before the blocks are made. The first pass is only there to find the link and footnote
+// definitions, so references can point to ones defined further down. Footnotes are numbered and heading ids handed
+// out again in the second pass.
+func (d *Document) parse() {
+	metadata, body := parseFrontMatter(d.raw)
+	d.metadata = metadata
+	blocks := NewBlocks(&body, d.options).getBlocks()
+
+	for _, block := range *blocks {
+		NewParser(&block, d).parse()
+	}
+	for _, footnote := range d.footnotes {
+		*footnote = FootnoteEntry{}
+	}
+	d.used = nil
+	d.ids = make(map[string]int)
+	d.headings = nil
+
+	d.nodes = make([]HtmlNode, 0)
+	for _, block := range *blocks {
+		d.nodes = append(d.nodes, NewParser(&block, d).parse())
+	}
+	if len(d.used) > 0 {
+		d.nodes = append(d.nodes, d.footnoteSection())
+	}
+
+	if sanitizer := d.options.sanitizer(); sanitizer != nil {
+		for index, node := range d.nodes {
+			d.nodes[index] = NewSanitizedNode(node, sanitizer)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (d *Document) addHeading(heading *ParentNode) {
+	d.headings = append(d.headings, heading)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The first definition of a label wins.
+func (d *Document) define(label string, definition *LinkDefinition) {
+	key := normalizeLabel(label)
+	if _, ok := d.definitions[key]; !ok {
+		d.definitions[key] = definition
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (d *Document) defineFootnote(label string, content *ParentNode) {
+	key := normalizeLabel(label)
+	footnote, ok := d.footnotes[key]
+	if !ok {
+		footnote = &FootnoteEntry{}
+		d.footnotes[key] = footnote
+	}
+	if footnote.content == nil {
+		footnote.content = content
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (d *Document) definition(label string) *LinkDefinition {
+	return d.definitions[normalizeLabel(label)]
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns nil when the footnote is not defined anywhere in the document.
+func (d *Document) footnote(label string) *FootnoteEntry {
+	return d.footnotes[normalizeLabel(label)]
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Counts a reference to the footnote, numbering it if it is the first one. Returns the id of the reference.
+func (d *Document) referenceFootnote(footnote *FootnoteEntry) string {
+	if footnote.number == 0 {
+		d.used = append(d.used, footnote)
+		footnote.number = len(d.used)
+	}
+	footnote.references++
+
+	return footnoteRefId(footnote.number, footnote.references)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// An id that is already taken gets a number added, so a second "intro" becomes "intro-1".
+func (d *Document) uniqueId(id string) string {
+	unique := id
+	if _, ok := d.ids[id]; ok {
+		for {
+			d.ids[id]++
+			unique = fmt.Sprintf("%v-%v", id, d.ids[id])
+			if _, ok := d.ids[unique]; !ok {
+				break
+			}
+		}
+	}
+	d.ids[unique] = 0
+
+	return unique
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Lists the footnotes in the order they were first referenced, each ending with links back to its references.
+func (d *Document) footnoteSection() HtmlNode {
+	items := make([]HtmlNode, 0, len(d.used))
+
+	for _, footnote := range d.used {
+		itemType := ListElement
+		item := NewParentNode(&itemType)
+		if footnote.content != nil {
+			item.childNodes = footnote.content.childNodes
+		}
+		item.addProperty("id", fmt.Sprintf("fn-%v", footnote.number))
+
+		target := item
+		if len(item.childNodes) > 0 {
+			if last, ok := item.childNodes[len(item.childNodes)-1].(*ParentNode); ok && last.nodeType == Paragraph {
+				target = last
+			}
+		}
+
+		for reference := 1; reference <= footnote.references; reference++ {
+			value := "↩"
+			nodeType := FootnoteBack
+			properties := map[string]string{
+				"href":  "#" + footnoteRefId(footnote.number, reference),
+				"class": "footnote-backref",
+			}
+			space := " "
+			spaceType := PlainText
+			target.childNodes = append(target.childNodes,
+				NewLeafNode(&space, &spaceType, nil), NewLeafNode(&value, &nodeType, &properties))
+		}
+
+		items = append(items, item)
+	}
+
+	listType := OrderedList
+	sectionType := Section
+	section := NewParentNode(&sectionType, NewParentNode(&listType, items...))
+	section.addProperty("class", "footnotes")
+	return section
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
+
+// The first reference to footnote 1 is fnref-1, the second fnref-1-2 and so on.
+func footnoteRefId(number, reference int) string {
+	if reference == 1 {
+		return fmt.Sprintf("fnref-%v", number)
+	}
+	return fmt.Sprintf("fnref-%v-%v", number, reference)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Lists the headings between the TocMinDepth and TocMaxDepth levels as nested lists of links. A heading more than one
+// level below the one before it is nested that many lists deep.
+func (d *Document) tableOfContents() HtmlNode {
+	type level struct {
+		depth int
+		list  *ParentNode
+	}
+
+	listType := UnorderedList
+	root := NewParentNode(&listType)
+	stack := make([]level, 0)
+
+	for _, heading := range d.headings {
+		depth, _ := strconv.Atoi(string(heading.nodeType[1:]))
+		if depth < d.options.TocMinDepth || depth > d.options.TocMaxDepth {
+			continue
+		}
+		if len(stack) == 0 {
+			stack = append(stack, level{depth: depth, list: root})
+		}
+
+		for len(stack) > 1 && stack[len(stack)-1].depth > depth {
+			stack = stack[:len(stack)-1]
+		}
+		for top := stack[len(stack)-1]; top.depth < depth; top = stack[len(stack)-1] {
+			itemType := ListElement
+			if len(top.list.childNodes) == 0 {
+				top.list.childNodes = append(top.list.childNodes, NewParentNode(&itemType))
+			}
+			item := top.list.childNodes[len(top.list.childNodes)-1].(*ParentNode)
+			nested := NewParentNode(&listType)
+			item.childNodes = append(item.childNodes, nested)
+			stack = append(stack, level{depth: top.depth + 1, list: nested})
+		}
+
+		text := heading.toText()
+		textType := PlainText
+		linkType := Link
+		link := NewParentNode(&linkType, NewLeafNode(&text, &textType, nil))
+		link.addProperty("href", "#"+heading.properties["id"])
+
+		itemType := ListElement
+		list := stack[len(stack)-1].list
+		list.childNodes = append(list.childNodes, NewParentNode(&itemType, link))
+	}
+
+	if len(root.childNodes) == 0 {
+		value := ""
+		nodeType := PlainText
+		return NewLeafNode(&value, &nodeType, nil)
+	}
+
+	navType := Nav
+	nav := NewParentNode(&navType, root)
+	nav.addProperty("class", "toc")
+	return nav
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Values from the front matter. Nested keys are joined with a dot, e.g. "author.name".
+func (d *Document) getMetadata() map[string]string {
+	return d.metadata
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The number of task list items in the document and how many of them are checked.
+func (d *Document) countTasks() (int, int) {
+	nodes := make([]HtmlNode, 0, len(d.nodes))
+	for _, node := range d.nodes {
+		if sanitized, ok := node.(*SanitizedNode); ok {
+			node = sanitized.node
+		}
+		nodes = append(nodes, node)
+	}
+
+	textType := PlainText
+	return NewParentNode(&textType, nodes...).countTasks()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The title set in the front matter, or else the text of the first top level heading.
+func (d *Document) title() string {
+	if title := d.metadata["title"]; title != "" {
+		return title
+	}
+
+	for _, heading := range d.headings {
+		if heading.nodeType == Heading1 {
+			return strings.TrimSpace(heading.toText())
+		}
+	}
+	return ""
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Blocks that only held link definitions leave nothing behind.
+func (d *Document) toHtml() string {
+	var out bytes.Buffer
+
+	for _, node := range d.nodes {
+		if html := node.toHtml(); html != "" {
+			out.WriteString(html + "\n")
+		}
+	}
+
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// TocNode
+// ----------------------------------------------------------------------------------------------------------------
+
+// Stands in for a table of contents. It is only rendered once the document is parsed, so it can list the headings
+// that come after it.
+type TocNode struct {
+	document *Document
+}
+
+func NewTocNode(document *Document) *TocNode {
+	return &TocNode{
+		document: document,
+	}
+}
+
+func (t *TocNode) toHtml() string {
+	return t.document.tableOfContents().toHtml()
+}
+
+func (t *TocNode) toText() string {
+	return ""
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -6,7 +6,7 @@ import (
 	"os"
 )
 
-func eval() {
+func eval(options *Options) {
 	fmt.Println("Markdown Parser - Enter a blankline to exit.\nAdd a filename when opening the program to parse a file instead")
 
 	for {
@@ -25,7 +25,7 @@ func eval() {
 		}
 
 		scrubbedData := input[:len(input)-1]
-		parser := NewParser(&scrubbedData)
-		fmt.Println(parser.parse().toHtml())
+		document := NewDocument(&scrubbedData, options)
+		fmt.Print(document.toHtml())
 	}
 }
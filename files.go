@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
@@ -30,15 +29,17 @@ type Files struct {
 	paths          []string
 	fileData       []*FileData
 	saveFolderPath string
+	options        *Options
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 // Object creation
 // ----------------------------------------------------------------------------------------------------------------
 
-func NewFiles(paths []string) *Files {
+func NewFiles(paths []string, options *Options) *Files {
 	files := &Files{
-		paths: paths,
+		paths:   paths,
+		options: options,
 	}
 	files.createFolderPath()
 	files.readFiles()
@@ -77,30 +78,9 @@ func (f *Files) createFolderPath() {
 
 func (f *Files) createFiles() {
 	for _, file := range *f.rawData() {
-		block := NewBlocks(&file.rawData)
-
-		parsedBlocks := make([]string, 0)
-
-		for _, block := range *block.getBlocks() {
-			parser := NewParser(&block)
-			parsedBlocks = append(parsedBlocks, parser.parse().toHtml())
-		}
-
-		html := f.createHtml(&parsedBlocks)
-		f.saveData(&html, &file.fileName)
-	}
-}
-
-// ----------------------------------------------------------------------------------------------------------------
-
-func (f *Files) createHtml(parsedBlocks *[]string) string {
-	var out bytes.Buffer
-
-	for _, block := range *parsedBlocks {
-		out.WriteString(block + "\n")
+		document := NewDocument(&file.rawData, f.options)
+		f.saveData(document, &file.fileName)
 	}
-
-	return out.String()
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -112,15 +92,6 @@ func (f *Files) createFilePath(fileName *string) string {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (f *Files) getTitle(parsedData *string) string {
-	if strings.Contains(*parsedData, "h1") {
-		return strings.Split(strings.Split(*parsedData, "<h1>")[1], "</h1>")[0]
-	}
-	return "Page"
-}
-
-// ----------------------------------------------------------------------------------------------------------------
-
 func (f *Files) rawData() *[]*FileData {
 	return &f.fileData
 }
@@ -142,35 +113,77 @@ func (f *Files) readFiles() {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (f *Files) saveData(parsedData *string, filename *string) {
+func (f *Files) saveData(document *Document, filename *string) {
 	f.createFolder()
 
-	saveFile := f.boilerPlate()
-	saveFile = strings.Replace(saveFile, "{{ Title }}", f.getTitle(parsedData), 1)
-	saveFile = strings.Replace(saveFile, "{{ Content }}", *parsedData, 1)
-
-	err := os.WriteFile(f.createFilePath(filename), []byte(saveFile), 0777)
+	err := os.WriteFile(f.createFilePath(filename), []byte(f.page(document)), 0777)
 	if err != nil {
 		fmt.Println(fmt.Errorf("error creating file %v : %v", *filename, err))
 	}
 }
 
+// ----------------------------------------------------------------------------------------------------------------
+
+// Front matter values fill the matching {{ key }} slots of the template, next to the title, description, language,
+// table of contents and content. Every slot is filled in one pass, so a value is never read as a slot itself, and the
+// built in slots cannot be taken over by a key of the same name.
+func (f *Files) page(document *Document) string {
+	toc := ""
+	if f.options.Toc {
+		toc = document.tableOfContents().toHtml()
+	}
+
+	metadata := document.getMetadata()
+	title := document.title()
+	if title == "" {
+		title = "Page"
+	}
+	lang := metadata["lang"]
+	if lang == "" {
+		lang = "en"
+	}
+
+	slots := []string{
+		"{{ Title }}", escapeHtml(title),
+		"{{ Description }}", escapeHtml(metadata["description"]),
+		"{{ Lang }}", escapeHtml(lang),
+		"{{ TOC }}", toc,
+		"{{ Content }}", document.toHtml(),
+	}
+	for key, value := range metadata {
+		slots = append(slots, fmt.Sprintf("{{ %v }}", key), escapeHtml(value))
+	}
+
+	return strings.NewReplacer(slots...).Replace(f.boilerPlate())
+}
+
 // ----------------------------------------------------------------------------------------------------------------
 // Base for every file produced by the program
 // ----------------------------------------------------------------------------------------------------------------
 
+// A template given with -template replaces the built in one. The built in one is used when it cannot be read.
 func (f *Files) boilerPlate() string {
+	if f.options.Template != "" {
+		data, err := os.ReadFile(f.options.Template)
+		if err == nil {
+			return string(data)
+		}
+		fmt.Println(fmt.Errorf("error reading template %v : %v", f.options.Template, err))
+	}
+
 	return `<!DOCTYPE html>
-<html>
+<html lang="{{ Lang }}">
 
 <head>
     <meta charset="utf-8">
     <meta name="viewport" content="width=device-width, initial-scale=1">
+    <meta name="description" content="{{ Description }}">
     <title> {{ Title }} </title>
     <link href="./index.css" rel="stylesheet">
 </head>
 
 <body>
+    {{ TOC }}
     <article>
         {{ Content }}
     </article>
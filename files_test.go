@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestPageFillsTemplateSlots(t *testing.T) {
+	input := "---\ntitle: Rivendell & co\ndescription: \"{{ Content }}\"\nauthor: \"{{ Title }}\"\nTitle: Taken\n---\n" +
+		"# Heading\n\nBody"
+	files := &Files{options: NewOptions()}
+	page := files.page(NewDocument(&input, files.options))
+
+	wants := []string{
+		`<html lang="en">`,
+		`<meta name="description" content="{{ Content }}">`,
+		`<title> Rivendell &amp; co </title>`,
+		"<h1 id=\"heading\">Heading</h1>\n<p>Body</p>",
+	}
+	for _, want := range wants {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%v", want, page)
+		}
+	}
+	if strings.Count(page, "<p>Body</p>") != 1 {
+		t.Errorf("page content was put in more than once:\n%v", page)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestPageFillsCustomSlots(t *testing.T) {
+	template := filepath.Join(t.TempDir(), "page.html")
+	if err := os.WriteFile(template, []byte("{{ Title }} by {{ author.name }}: {{ Content }}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	input := "+++\ntitle = \"Notes\"\n[author]\nname = \"Bilbo <B>\"\n+++\nText {{ author.name }}"
+	files := &Files{options: NewOptions()}
+	files.options.Template = template
+
+	want := "Notes by Bilbo &lt;B&gt;: <p>Text {{ author.name }}</p>\n"
+	if got := files.page(NewDocument(&input, files.options)); got != want {
+		t.Errorf("page is %q, want %q", got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// Reads the YAML or TOML front matter at the top of a file. Only the simple parts of each language are understood:
+// strings, numbers, lists and one level of nesting, which is what page metadata tends to use.
+// ----------------------------------------------------------------------------------------------------------------
+
+// Splits front matter fenced by --- (YAML) or +++ (TOML) off the start of the input. Returns an empty map and the
+// input unchanged when there is no front matter. As in Pandoc, a --- followed by a blank line is a thematic break
+// rather than the start of front matter.
+func parseFrontMatter(raw string) (map[string]string, string) {
+	metadata := make(map[string]string)
+
+	raw = strings.TrimPrefix(raw, "\uFEFF")
+	lines := strings.SplitAfter(raw, "\n")
+	fence := strings.TrimRight(lines[0], " \t\r\n")
+	if fence != "---" && fence != "+++" {
+		return metadata, raw
+	}
+	if fence == "---" && (len(lines) < 2 || isBlank(lines[1])) {
+		return metadata, raw
+	}
+
+	for index := 1; index < len(lines); index++ {
+		line := strings.TrimRight(lines[index], " \t\r\n")
+		if line != fence && (fence != "---" || line != "...") {
+			continue
+		}
+
+		content := make([]string, 0, index-1)
+		for _, line := range lines[1:index] {
+			content = append(content, strings.TrimRight(line, "\r\n"))
+		}
+
+		if fence == "---" {
+			parseYaml(content, metadata)
+		} else {
+			parseToml(content, metadata)
+		}
+		return metadata, strings.Join(lines[index+1:], "")
+	}
+
+	return metadata, raw
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Understands "key: value" pairs, quoted strings, [flow, lists], "- item" lists, | and > block strings and keys
+// nested one level deep, which are stored as "parent.key".
+func parseYaml(lines []string, metadata map[string]string) {
+	parent := ""
+
+	for index := 0; index < len(lines); index++ {
+		line := stripComment(lines[index])
+		if isBlank(line) {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+
+		if leadingColumns(line) > 0 && parent != "" {
+			if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+				item := unquoteValue(strings.TrimSpace(trimmed[1:]))
+				if metadata[parent] != "" {
+					item = metadata[parent] + ", " + item
+				}
+				metadata[parent] = item
+			} else if key, value, ok := splitPair(trimmed, ':'); ok {
+				metadata[parent+"."+key] = metadataValue(value)
+			}
+			continue
+		}
+
+		key, value, ok := splitPair(trimmed, ':')
+		if !ok {
+			continue
+		}
+		parent = ""
+
+		switch {
+		case value == "":
+			parent = key
+			metadata[key] = ""
+		case strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">"):
+			block := make([]string, 0)
+			for index+1 < len(lines) && (isBlank(lines[index+1]) || leadingColumns(lines[index+1]) > 0) {
+				index++
+				block = append(block, strings.TrimSpace(lines[index]))
+			}
+
+			separator := "\n"
+			if value[0] == '>' {
+				separator = " "
+			}
+			metadata[key] = strings.TrimSpace(strings.Join(block, separator))
+		default:
+			metadata[key] = metadataValue(value)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Understands "key = value" pairs, strings, arrays, [table] headers, whose keys are stored as "table.key", and
+// strings and arrays that run over several lines.
+func parseToml(lines []string, metadata map[string]string) {
+	table := ""
+
+	for index := 0; index < len(lines); index++ {
+		trimmed := strings.TrimSpace(stripComment(lines[index]))
+		if trimmed == "" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			table = strings.Trim(trimmed, "[] \t") + "."
+			continue
+		}
+
+		key, value, ok := splitPair(trimmed, '=')
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(value, "\"\"\"") || strings.HasPrefix(value, "'''"):
+			quotes := value[:3]
+			text := strings.TrimPrefix(value[3:], "\n")
+			for !strings.Contains(text, quotes) && index+1 < len(lines) {
+				index++
+				text += "\n" + lines[index]
+			}
+			text, _, _ = strings.Cut(text, quotes)
+			metadata[table+key] = strings.TrimPrefix(text, "\n")
+			continue
+		case strings.HasPrefix(value, "["):
+			for strings.Count(value, "[") > strings.Count(value, "]") && index+1 < len(lines) {
+				index++
+				value += " " + strings.TrimSpace(stripComment(lines[index]))
+			}
+		}
+
+		metadata[table+key] = metadataValue(value)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
+
+// A [list] becomes its items joined by commas, anything else is unquoted. YAML and TOML write both the same way.
+func metadataValue(value string) string {
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		return strings.Join(splitList(value[1:len(value)-1]), ", ")
+	}
+	return unquoteValue(value)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Splits "key: value" or "key = value" at the first separator outside quotes. The key may be quoted as well.
+func splitPair(line string, separator byte) (string, string, bool) {
+	index := indexOutsideQuotes(line, separator)
+	if index <= 0 {
+		return "", "", false
+	}
+
+	// A YAML key has to be followed by a space or the end of the line, so urls like "http://" are left alone.
+	if separator == ':' && index+1 < len(line) && line[index+1] != ' ' && line[index+1] != '\t' {
+		return "", "", false
+	}
+
+	key := unquoteValue(strings.TrimSpace(line[:index]))
+	return key, strings.TrimSpace(line[index+1:]), key != ""
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Splits the inside of a [list] on commas that are not inside quotes.
+func splitList(inner string) []string {
+	items := make([]string, 0)
+
+	for strings.TrimSpace(inner) != "" {
+		end := indexOutsideQuotes(inner, ',')
+		if end == -1 {
+			end = len(inner)
+		}
+
+		if item := strings.TrimSpace(inner[:end]); item != "" {
+			items = append(items, unquoteValue(item))
+		}
+		if end == len(inner) {
+			break
+		}
+		inner = inner[end+1:]
+	}
+
+	return items
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Removes a # comment that starts the line or follows whitespace, as long as it is not inside quotes.
+func stripComment(line string) string {
+	for index := indexOutsideQuotes(line, '#'); index != -1; {
+		if index == 0 || line[index-1] == ' ' || line[index-1] == '\t' {
+			return strings.TrimRight(line[:index], " \t")
+		}
+
+		next := indexOutsideQuotes(line[index+1:], '#')
+		if next == -1 {
+			break
+		}
+		index += next + 1
+	}
+	return line
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func indexOutsideQuotes(line string, target byte) int {
+	var quote byte
+	for index := 0; index < len(line); index++ {
+		switch ch := line[index]; {
+		case quote != 0:
+			if ch == '\\' && quote == '"' {
+				index++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == target:
+			return index
+		}
+	}
+	return -1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Double quoted strings take escapes such as \n. Inside single quotes a quote is written twice.
+func unquoteValue(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return value
+	}
+
+	switch {
+	case value[0] == '"' && value[len(value)-1] == '"':
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+		return value[1 : len(value)-1]
+	case value[0] == '\'' && value[len(value)-1] == '\'':
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	default:
+		return value
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestFrontMatter(t *testing.T) {
+	tests := []struct {
+		input string
+		key   string
+		value string
+		body  string
+	}{
+		{"---\ntitle: T\n---\nBody", "title", "T", "Body"},
+		{"---\ntags: [a, \"b c\"]\n...\nBody", "tags", "a, b c", "Body"},
+		{"---\nauthor:\n  name: N\n---\n", "author.name", "N", ""},
+		{"+++\n[author]\nname = 'N'\n+++\nBody", "author.name", "N", "Body"},
+		{"+++\ntags = [\"a\", \"b\"]\n+++\n", "tags", "a, b", ""},
+	}
+
+	for _, test := range tests {
+		metadata, body := parseFrontMatter(test.input)
+		if metadata[test.key] != test.value || body != test.body {
+			t.Errorf("%q read %v as %q with body %q, want %q with body %q", test.input, test.key,
+				metadata[test.key], body, test.value, test.body)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestThematicBreakIsNotFrontMatter(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"---\n\npara\n\n---\nafter", "<hr>\n<p>para</p>\n<hr>\n<p>after</p>\n"},
+		{"---\n", "<hr>\n"},
+		{"---\ntitle: T\n---\nBody", "<p>Body</p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
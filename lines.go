@@ -0,0 +1,590 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// Line level helpers shared by Blocks and Parser.
+// ----------------------------------------------------------------------------------------------------------------
+
+type Fence struct {
+	char   rune
+	length int
+	indent int
+	info   string
+}
+
+type ListMarker struct {
+	indent  int
+	ordered bool
+	char    byte
+	number  int
+	end     int
+	offset  int
+	empty   bool
+}
+
+// Tags that start an html block even when they are not alone on their line.
+var htmlBlockTags = []string{
+	"address", "article", "aside", "base", "basefont", "blockquote", "body", "caption", "center", "col", "colgroup",
+	"dd", "details", "dialog", "dir", "div", "dl", "dt", "fieldset", "figcaption", "figure", "footer", "form", "frame",
+	"frameset", "h1", "h2", "h3", "h4", "h5", "h6", "head", "header", "hr", "html", "iframe", "legend", "li", "link",
+	"main", "menu", "menuitem", "nav", "noframes", "ol", "optgroup", "option", "p", "param", "search", "section",
+	"summary", "table", "tbody", "td", "tfoot", "th", "thead", "title", "tr", "track", "ul",
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Object creation
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns nil when the line does not start a list item. The offset is the column the item's content starts at.
+func listMarker(line string) *ListMarker {
+	indent := leadingSpaces(line)
+	if indent > 3 || isThematicBreak(line) {
+		return nil
+	}
+
+	marker := &ListMarker{indent: indent}
+	index := indent
+
+	switch {
+	case index < len(line) && (line[index] == '-' || line[index] == '+' || line[index] == '*'):
+		marker.char = line[index]
+		index++
+	case index < len(line) && isDigit(line[index]):
+		digits := 0
+		for index < len(line) && isDigit(line[index]) {
+			index++
+			digits++
+		}
+		if digits > 9 || index >= len(line) || (line[index] != '.' && line[index] != ')') {
+			return nil
+		}
+		marker.ordered = true
+		marker.char = line[index]
+		marker.number, _ = strconv.Atoi(line[indent:index])
+		index++
+	default:
+		return nil
+	}
+
+	// Tabs after the marker stop relative to the start of the line, so the marker is counted as spaces.
+	rest := line[index:]
+	spaces := leadingColumns(strings.Repeat(" ", index)+rest) - index
+	marker.end = index
+
+	switch {
+	case isBlank(rest):
+		marker.empty = true
+		marker.offset = index + 1
+	case spaces == 0:
+		return nil
+	case spaces > 4:
+		marker.offset = index + 1
+	default:
+		marker.offset = index + spaces
+	}
+
+	return marker
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns nil when the line does not open a fenced code block.
+func openingFence(line string) *Fence {
+	indent := leadingSpaces(line)
+	if indent > 3 {
+		return nil
+	}
+
+	rest := line[indent:]
+	if len(rest) == 0 || (rest[0] != '`' && rest[0] != '~') {
+		return nil
+	}
+
+	char := rest[0]
+	length := 0
+	for length < len(rest) && rest[length] == char {
+		length++
+	}
+	if length < 3 {
+		return nil
+	}
+
+	info := strings.TrimSpace(rest[length:])
+	if char == '`' && strings.ContainsRune(info, '`') {
+		return nil
+	}
+
+	return &Fence{
+		char:   rune(char),
+		length: length,
+		indent: indent,
+		info:   info,
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Methods
+// ----------------------------------------------------------------------------------------------------------------
+
+func (f *Fence) isClosedBy(line string) bool {
+	indent := leadingSpaces(line)
+	if indent > 3 {
+		return false
+	}
+
+	rest := strings.TrimRight(line[indent:], " \t")
+	if len(rest) < f.length {
+		return false
+	}
+
+	for _, ch := range rest {
+		if ch != f.char {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The first word of the info string, e.g. "go" for ```go.
+func (f *Fence) language() string {
+	fields := strings.Fields(f.info)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The item's text once the marker and its indentation are removed.
+func (m *ListMarker) content(line string) string {
+	return removeColumns(strings.Repeat(" ", m.end)+line[m.end:], m.offset)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (m *ListMarker) sameList(other *ListMarker) bool {
+	return m.ordered == other.ordered && m.char == other.char
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Content lines lose as much indentation as the opening fence had.
+func (f *Fence) stripIndent(line string) string {
+	return line[min(leadingSpaces(line), f.indent):]
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the level of an ATX heading such as "## Title", or 0 when the line is not one.
+func atxLevel(line string) int {
+	if leadingSpaces(line) > 3 {
+		return 0
+	}
+
+	trimmed := strings.TrimLeft(line, " ")
+	level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+	if level == 0 || level > 6 {
+		return 0
+	}
+	if level < len(trimmed) && trimmed[level] != ' ' && trimmed[level] != '\t' {
+		return 0
+	}
+	return level
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the text of an ATX heading line once its opening marker is gone, without a closing run of #.
+func atxContent(text string) string {
+	text = strings.TrimSpace(text)
+	trimmed := strings.TrimRight(text, "#")
+
+	if trimmed == "" || strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t") {
+		return strings.TrimSpace(trimmed)
+	}
+	return text
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Splits a trailing {#custom-id} off heading text. The id is empty when there is not one.
+func customHeadingId(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	start := strings.LastIndex(text, "{#")
+	if start == -1 || !strings.HasSuffix(text, "}") {
+		return "", text
+	}
+
+	id := text[start+2 : len(text)-1]
+	if id == "" || strings.IndexFunc(id, func(ch rune) bool {
+		return ch > 127 || !(isAlphaNumeric(byte(ch)) || strings.ContainsRune("-_:.", ch))
+	}) != -1 {
+		return "", text
+	}
+	return id, strings.TrimSpace(text[:start])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Only lists starting at one and holding text may interrupt a paragraph, so numbers inside prose stay prose. The same
+// goes for a lone html tag, which is only the start of an html block when a paragraph is not open.
+func interruptsParagraph(line string) bool {
+	if openingFence(line) != nil || isThematicBreak(line) || isQuoteLine(line) || atxLevel(line) > 0 {
+		return true
+	}
+	if kind := htmlBlockStart(line); kind > 0 && kind < 7 {
+		return true
+	}
+
+	marker := listMarker(line)
+	if marker == nil || marker.empty {
+		return false
+	}
+	return !marker.ordered || marker.number == 1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the alignment of each column when the line is a table delimiter row such as "| :-- | :-: | --: |", or nil
+// when it is not one.
+func tableAlignments(line string) []string {
+	if !strings.Contains(line, "|") {
+		return nil
+	}
+
+	cells := splitTableRow(line)
+	alignments := make([]string, 0, len(cells))
+
+	for _, cell := range cells {
+		left := strings.HasPrefix(cell, ":")
+		right := strings.HasSuffix(cell, ":")
+		dashes := strings.TrimSuffix(strings.TrimPrefix(cell, ":"), ":")
+		if dashes == "" || strings.Trim(dashes, "-") != "" {
+			return nil
+		}
+
+		switch {
+		case left && right:
+			alignments = append(alignments, "center")
+		case left:
+			alignments = append(alignments, "left")
+		case right:
+			alignments = append(alignments, "right")
+		default:
+			alignments = append(alignments, "")
+		}
+	}
+
+	return alignments
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A table needs a header row followed by a delimiter row with the same number of cells.
+func isTableStart(lines []string) bool {
+	if len(lines) < 2 || !strings.Contains(lines[0], "|") || leadingSpaces(lines[0]) > 3 {
+		return false
+	}
+
+	alignments := tableAlignments(lines[1])
+	return alignments != nil && len(alignments) == len(splitTableRow(lines[0]))
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns which of the seven kinds of html block the line starts, numbered as in CommonMark, or 0 when it starts none.
+func htmlBlockStart(line string) int {
+	if leadingSpaces(line) > 3 {
+		return 0
+	}
+
+	trimmed := strings.TrimLeft(line, " ")
+	lower := strings.ToLower(trimmed)
+	if !strings.HasPrefix(lower, "<") {
+		return 0
+	}
+
+	switch {
+	case htmlTagFollows(lower[1:], []string{"pre", "script", "style", "textarea"}, false):
+		return 1
+	case strings.HasPrefix(lower, "<!--"):
+		return 2
+	case strings.HasPrefix(lower, "<?"):
+		return 3
+	case len(lower) > 2 && lower[1] == '!' && lower[2] >= 'a' && lower[2] <= 'z':
+		return 4
+	case strings.HasPrefix(trimmed, "<![CDATA["):
+		return 5
+	case htmlTagFollows(strings.TrimPrefix(lower[1:], "/"), htmlBlockTags, true):
+		return 6
+	}
+
+	tag, end := scanTag(trimmed, 0)
+	if tag != nil && isBlank(trimmed[end:]) && !htmlTagFollows(tag.name, []string{"pre", "script", "style", "textarea"}, false) {
+		return 7
+	}
+	return 0
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Html blocks of the first five kinds end on the line holding their closing text, the other two end at a blank line.
+func htmlBlockEnds(kind int, line string) bool {
+	lower := strings.ToLower(line)
+
+	switch kind {
+	case 1:
+		return strings.Contains(lower, "</pre>") || strings.Contains(lower, "</script>") ||
+			strings.Contains(lower, "</style>") || strings.Contains(lower, "</textarea>")
+	case 2:
+		return strings.Contains(line, "-->")
+	case 3:
+		return strings.Contains(line, "?>")
+	case 4:
+		return strings.Contains(line, ">")
+	case 5:
+		return strings.Contains(line, "]]>")
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Whether the text starts with one of the tag names followed by whitespace, the end of the line or the end of the tag.
+func htmlTagFollows(text string, names []string, selfClosing bool) bool {
+	for _, name := range names {
+		if !strings.HasPrefix(text, name) {
+			continue
+		}
+
+		rest := text[len(name):]
+		if rest == "" || strings.ContainsRune(" \t>", rune(rest[0])) || (selfClosing && strings.HasPrefix(rest, "/>")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A block holding only [TOC] or <!-- toc --> is replaced by a table of contents.
+func isTocPlaceholder(block string) bool {
+	switch strings.ToLower(strings.TrimSpace(block)) {
+	case "[toc]", "<!-- toc -->":
+		return true
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Three or more of the same -, * or _ characters, optionally spaced out, e.g. "***" or "- - -".
+func isThematicBreak(line string) bool {
+	if leadingSpaces(line) > 3 {
+		return false
+	}
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || !strings.ContainsRune("-*_", rune(trimmed[0])) {
+		return false
+	}
+
+	count := 0
+	for _, ch := range trimmed {
+		switch ch {
+		case rune(trimmed[0]):
+			count++
+		case ' ', '\t':
+		default:
+			return false
+		}
+	}
+
+	return count >= 3
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isQuoteLine(line string) bool {
+	return leadingSpaces(line) <= 3 && strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Removes the > marker from a quote line along with one column of the space after it. A tab after the marker only
+// loses the one column, so the rest of it is kept as spaces.
+func quoteContent(line string) string {
+	indent := leadingSpaces(line)
+	rest := line[indent+1:]
+
+	switch {
+	case strings.HasPrefix(rest, " "):
+		return rest[1:]
+	case strings.HasPrefix(rest, "\t"):
+		width := 4 - (indent+1)%4
+		return strings.Repeat(" ", width-1) + rest[1:]
+	default:
+		return rest
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Makes an id the way GitHub does: lower case, with spaces turned into hyphens and punctuation removed.
+func slug(text string) string {
+	var out strings.Builder
+	for _, ch := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case ch == ' ':
+			out.WriteRune('-')
+		case ch == '-' || ch == '_' || unicode.IsLetter(ch) || unicode.IsNumber(ch) || unicode.IsMark(ch):
+			out.WriteRune(ch)
+		}
+	}
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isAsciiPunctuation(ch rune) bool {
+	return ch < 128 && ch != EOF && strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", ch)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isAlphaNumeric(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Indentation in columns, with tabs stopping at multiples of four.
+func leadingColumns(line string) int {
+	columns := 0
+	for _, ch := range line {
+		switch ch {
+		case ' ':
+			columns++
+		case '\t':
+			columns += 4 - columns%4
+		default:
+			return columns
+		}
+	}
+	return columns
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func leadingSpaces(line string) int {
+	count := 0
+	for count < len(line) && line[count] == ' ' {
+		count++
+	}
+	return count
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns 1 for a line of = and 2 for a line of -, the levels they give the paragraph above them, or 0 when the
+// line is not a setext underline.
+func setextLevel(line string) int {
+	if leadingSpaces(line) > 3 {
+		return 0
+	}
+
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed == "":
+		return 0
+	case strings.Trim(trimmed, "=") == "":
+		return 1
+	case strings.Trim(trimmed, "-") == "":
+		return 2
+	default:
+		return 0
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Splits a table row on its unescaped pipes. The outer pipes are optional and cells are trimmed.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = line[:len(line)-1]
+	}
+
+	cells := make([]string, 0)
+	start := 0
+	for index := 0; index < len(line); index++ {
+		switch line[index] {
+		case '\\':
+			index++
+		case '|':
+			cells = append(cells, strings.TrimSpace(line[start:index]))
+			start = index + 1
+		}
+	}
+
+	return append(cells, strings.TrimSpace(line[start:]))
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Removes up to the given number of columns of indentation. A tab that is only partly removed leaves spaces behind.
+func removeColumns(line string, columns int) string {
+	removed := 0
+	for index, ch := range line {
+		if removed >= columns {
+			return line[index:]
+		}
+
+		switch ch {
+		case ' ':
+			removed++
+		case '\t':
+			width := 4 - removed%4
+			if removed+width > columns {
+				return strings.Repeat(" ", removed+width-columns) + line[index+1:]
+			}
+			removed += width
+		default:
+			return line[index:]
+		}
+	}
+	return ""
+}
+
+// ----------------------------------------------------------------------------------------------------------------
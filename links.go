@@ -0,0 +1,431 @@
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helpers for the parts of links that are read straight from the input: autolinks, destinations, titles and the
+// definitions reference links point to.
+// ----------------------------------------------------------------------------------------------------------------
+
+type LinkDefinition struct {
+	destination string
+	title       string
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Object creation
+// ----------------------------------------------------------------------------------------------------------------
+
+// Reads a definition such as [label]: /url "title" from the start of the text. Returns the label, the definition and
+// the offset just past its line, or a nil definition when the text does not start with one.
+func linkDefinition(text string) (string, *LinkDefinition, int) {
+	if leadingSpaces(text) > 3 {
+		return "", nil, 0
+	}
+
+	start := leadingSpaces(text)
+	end := labelEnd(text, start)
+	if end == -1 || end+1 >= len(text) || text[end+1] != ':' {
+		return "", nil, 0
+	}
+	label := text[start+1 : end]
+
+	destinationStart := skipLinkSpace(text, end+2)
+	destination, destinationEnd := linkDestination(text, destinationStart)
+	if destinationEnd == -1 || (destination == "" && (destinationStart >= len(text) || text[destinationStart] != '<')) {
+		return "", nil, 0
+	}
+
+	// A title has to be separated from the destination and followed by nothing but the end of its line.
+	if titleStart := skipLinkSpace(text, destinationEnd); titleStart > destinationEnd {
+		if title, titleEnd := linkTitle(text, titleStart); titleEnd != -1 {
+			if lineEnd := restOfLineEnd(text, titleEnd); lineEnd != -1 {
+				return label, &LinkDefinition{destination: destination, title: title}, lineEnd
+			}
+		}
+	}
+
+	if lineEnd := restOfLineEnd(text, destinationEnd); lineEnd != -1 {
+		return label, &LinkDefinition{destination: destination}, lineEnd
+	}
+	return "", nil, 0
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
+
+// Whether the text is a scheme such as "https" followed by a colon and no spaces or angle brackets.
+func isAbsoluteUri(text string) bool {
+	colon := strings.IndexByte(text, ':')
+	if colon < 2 || colon > 32 || isDigit(text[0]) || !isAlphaNumeric(text[0]) {
+		return false
+	}
+
+	for index := 1; index < colon; index++ {
+		if !isAlphaNumeric(text[index]) && strings.IndexByte("+.-", text[index]) == -1 {
+			return false
+		}
+	}
+
+	for index := colon + 1; index < len(text); index++ {
+		if text[index] <= ' ' || text[index] == '<' || text[index] == '>' || text[index] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Accepts the addresses HTML5 allows in an email input.
+func isEmailAddress(text string) bool {
+	at := strings.IndexByte(text, '@')
+	if at < 1 {
+		return false
+	}
+
+	for index := 0; index < at; index++ {
+		if !isAlphaNumeric(text[index]) && strings.IndexByte(".!#$%&'*+/=?^_`{|}~-", text[index]) == -1 {
+			return false
+		}
+	}
+
+	for _, label := range strings.Split(text[at+1:], ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for index := 0; index < len(label); index++ {
+			if !isAlphaNumeric(label[index]) && label[index] != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the length of a bare www., http:// or https:// link or email address at the start of the text, along
+// with the url it points to. The length is 0 when there is no link.
+func extendedAutolink(text string) (int, string) {
+	// Only the start of the text can match, so only the start is lowered.
+	lower := strings.ToLower(text[:min(len(text), len("https://"))])
+
+	var start int
+	var allowShort bool
+	switch {
+	case strings.HasPrefix(lower, "www."):
+		start = 0
+	case strings.HasPrefix(lower, "http://"):
+		start, allowShort = len("http://"), true
+	case strings.HasPrefix(lower, "https://"):
+		start, allowShort = len("https://"), true
+	default:
+		if end := emailAutolinkEnd(text); end > 0 {
+			return end, "mailto:" + text[:end]
+		}
+		return 0, ""
+	}
+
+	if domainEnd(text, start, allowShort) == -1 {
+		return 0, ""
+	}
+
+	end := start
+	for end < len(text) && text[end] > ' ' && text[end] != '<' {
+		end++
+	}
+	end = trimAutolink(text[:end])
+
+	if start == 0 {
+		return end, "http://" + text[:end]
+	}
+	return end, text[:end]
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Domains are segments of letters, digits, underscores and hyphens separated by periods. The last two segments may
+// not hold underscores and, unless allowShort is set, there has to be at least one period.
+func domainEnd(text string, start int, allowShort bool) int {
+	end := start
+	periods := 0
+	underscores := []bool{false}
+
+	for end < len(text) {
+		ch := text[end]
+		if ch == '.' {
+			if end+1 >= len(text) || !(isAlphaNumeric(text[end+1]) || text[end+1] == '-' || text[end+1] == '_') {
+				break
+			}
+			periods++
+			underscores = append(underscores, false)
+		} else if ch == '_' {
+			underscores[len(underscores)-1] = true
+		} else if !isAlphaNumeric(ch) && ch != '-' {
+			break
+		}
+		end++
+	}
+
+	if end == start || (periods == 0 && !allowShort) {
+		return -1
+	}
+	for _, underscore := range underscores[max(0, len(underscores)-2):] {
+		if underscore {
+			return -1
+		}
+	}
+	return end
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func emailAutolinkEnd(text string) int {
+	at := 0
+	for at < len(text) && (isAlphaNumeric(text[at]) || strings.IndexByte(".+-_", text[at]) != -1) {
+		at++
+	}
+	if at == 0 || at >= len(text) || text[at] != '@' {
+		return 0
+	}
+
+	end := at + 1
+	periods := 0
+	for end < len(text) && (isAlphaNumeric(text[end]) || strings.IndexByte(".-_", text[end]) != -1) {
+		if text[end] == '.' {
+			if end+1 >= len(text) || !isAlphaNumeric(text[end+1]) {
+				break
+			}
+			periods++
+		}
+		end++
+	}
+
+	if periods == 0 || text[end-1] == '-' || text[end-1] == '_' {
+		return 0
+	}
+	return end
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Punctuation at the end of a link is usually part of the sentence around it. A closing parenthesis only stays when
+// it has a partner inside the link, and something that looks like an entity reference is dropped entirely.
+func trimAutolink(link string) int {
+	end := len(link)
+
+	for end > 0 {
+		switch ch := link[end-1]; {
+		case strings.IndexByte("?!.,:*_~'\"", ch) != -1:
+			end--
+		case ch == ')' && strings.Count(link[:end], ")") > strings.Count(link[:end], "("):
+			end--
+		case ch == ';':
+			start := end - 1
+			for start > 0 && isAlphaNumeric(link[start-1]) {
+				start--
+			}
+			if start == end-1 || start == 0 || link[start-1] != '&' {
+				return end
+			}
+			end = start - 1
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the label of a footnote definition such as "[^1]: text" and the offset its text starts at, or -1 as the
+// offset when the line does not start one.
+func footnoteDefinition(line string) (string, int) {
+	start := leadingSpaces(line)
+	if start > 3 || !strings.HasPrefix(line[start:], "[^") {
+		return "", -1
+	}
+
+	end := labelEnd(line, start)
+	if end == -1 || end+1 >= len(line) || line[end+1] != ':' || !isFootnoteLabel(line[start+2:end]) {
+		return "", -1
+	}
+	return line[start+2 : end], end + 2
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Footnote labels are a single word.
+func isFootnoteLabel(label string) bool {
+	return label != "" && !strings.ContainsAny(label, " \t\n")
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the index of the ] closing the label that opens at index, or -1. Labels cannot hold unescaped brackets,
+// may not be blank and are at most 999 characters long.
+func labelEnd(text string, index int) int {
+	if index >= len(text) || text[index] != '[' {
+		return -1
+	}
+
+	for end := index + 1; end < len(text) && end-index <= 1000; end++ {
+		switch text[end] {
+		case '\\':
+			end++
+		case '[':
+			return -1
+		case ']':
+			if isBlank(text[index+1 : end]) {
+				return -1
+			}
+			return end
+		}
+	}
+	return -1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the destination starting at index, either wrapped in <> or running up to whitespace with balanced
+// parentheses, along with the offset just past it. The offset is -1 when there is no valid destination.
+func linkDestination(text string, index int) (string, int) {
+	if index < len(text) && text[index] == '<' {
+		for end := index + 1; end < len(text); end++ {
+			switch text[end] {
+			case '\\':
+				end++
+			case '\n', '<':
+				return "", -1
+			case '>':
+				return unescapeLinkText(text[index+1 : end]), end + 1
+			}
+		}
+		return "", -1
+	}
+
+	depth := 0
+	end := index
+	for ; end < len(text) && text[end] > ' ' && text[end] != 0x7f; end++ {
+		switch text[end] {
+		case '\\':
+			if end+1 < len(text) && isAsciiPunctuation(rune(text[end+1])) {
+				end++
+			}
+		case '(':
+			depth++
+			if depth > 32 {
+				return "", -1
+			}
+		case ')':
+			if depth == 0 {
+				return unescapeLinkText(text[index:end]), end
+			}
+			depth--
+		}
+	}
+
+	if depth != 0 {
+		return "", -1
+	}
+	return unescapeLinkText(text[index:end]), end
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns a title wrapped in double quotes, single quotes or parentheses starting at index, along with the offset
+// just past it. The offset is -1 when there is no valid title. Titles may span lines but not blank ones.
+func linkTitle(text string, index int) (string, int) {
+	if index >= len(text) {
+		return "", -1
+	}
+
+	closing := text[index]
+	switch closing {
+	case '"', '\'':
+	case '(':
+		closing = ')'
+	default:
+		return "", -1
+	}
+
+	for end := index + 1; end < len(text); end++ {
+		switch {
+		case text[end] == '\\':
+			end++
+		case text[end] == closing:
+			return unescapeLinkText(text[index+1 : end]), end + 1
+		case text[end] == '(' && closing == ')':
+			return "", -1
+		case text[end] == '\n' && isBlank(strings.SplitN(text[end+1:], "\n", 2)[0]):
+			return "", -1
+		}
+	}
+	return "", -1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Labels match regardless of case and of how whitespace inside them is laid out. Unicode case folding also maps ß to
+// ss, which upper and lower casing alone cannot do.
+func normalizeLabel(label string) string {
+	folded := strings.ToLower(strings.ToUpper(strings.Join(strings.Fields(label), " ")))
+	return strings.ReplaceAll(folded, "ß", "ss")
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the offset just past the end of the line when only spaces and tabs are left on it, or -1.
+func restOfLineEnd(text string, index int) int {
+	for ; index < len(text); index++ {
+		switch text[index] {
+		case ' ', '\t':
+		case '\n':
+			return index + 1
+		default:
+			return -1
+		}
+	}
+	return index
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Skips spaces and tabs along with at most one line ending.
+func skipLinkSpace(text string, index int) int {
+	newline := false
+	for ; index < len(text); index++ {
+		switch text[index] {
+		case ' ', '\t':
+		case '\n':
+			if newline {
+				return index
+			}
+			newline = true
+		default:
+			return index
+		}
+	}
+	return index
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Destinations and titles take backslash escapes and entity references but nothing else from inline markdown.
+func unescapeLinkText(text string) string {
+	var out strings.Builder
+	for index := 0; index < len(text); index++ {
+		if text[index] == '\\' && index+1 < len(text) && isAsciiPunctuation(rune(text[index+1])) {
+			index++
+		}
+		out.WriteByte(text[index])
+	}
+	return html.UnescapeString(out.String())
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestLinkDefinition(t *testing.T) {
+	tests := []struct {
+		text        string
+		label       string
+		destination string
+		title       string
+		ok          bool
+	}{
+		{"[x]: /url", "x", "/url", "", true},
+		{"[x]: /url \"Title\"\nrest", "x", "/url", "Title", true},
+		{"[x]: <>", "x", "", "", true},
+		{"[x]:", "", "", "", false},
+		{"[x]: ", "", "", "", false},
+		{"[x]:\n", "", "", "", false},
+		{"[x]: /url \"Title\" junk", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		label, definition, _ := linkDefinition(test.text)
+		if (definition != nil) != test.ok {
+			t.Errorf("linkDefinition(%q) returned %v, want a definition: %v", test.text, definition, test.ok)
+			continue
+		}
+		if definition != nil && (label != test.label || definition.destination != test.destination ||
+			definition.title != test.title) {
+			t.Errorf("linkDefinition(%q) = %q %+v", test.text, label, *definition)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestEmptyDefinitionAtEndOfFile(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[x]:", "<p>[x]:</p>\n"},
+		{"text\n\n[x]: ", "<p>text</p>\n<p>[x]:</p>\n"},
+		{"[x]:\n", "<p>[x]:</p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestUnresolvedBracketsKeepTheirContent(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[*a*] b", "<p>[<i>a</i>] b</p>\n"},
+		{"[`code`]", "<p>[<code>code</code>]</p>\n"},
+		{"[see *this*](", "<p>[see <i>this</i>](</p>\n"},
+		{"![*alt*][nope]", "<p>![<i>alt</i>][nope]</p>\n"},
+		{"[*a*][nope] [b]\n\n[b]: /b", "<p>[<i>a</i>][nope] <a href=\"/b\">b</a></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestAutolinks(t *testing.T) {
+	input := "<https://a.b/c> <x@y.zz>"
+	want := "<p><a href=\"https://a.b/c\">https://a.b/c</a> <a href=\"mailto:x@y.zz\">x@y.zz</a></p>\n"
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+
+	options := NewOptions()
+	options.Autolinks = true
+	input = "see www.a.com and https://b.c/d. or x@y.zz"
+	want = "<p>see <a href=\"http://www.a.com\">www.a.com</a> and <a href=\"https://b.c/d\">https://b.c/d</a>. " +
+		"or <a href=\"mailto:x@y.zz\">x@y.zz</a></p>\n"
+	if got := renderMarkdown(input, options); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestReferenceLinks(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"[a][ref] [ref][] [ref]\n\n[ref]: /url \"Title\"",
+			"<p><a href=\"/url\" title=\"Title\">a</a> <a href=\"/url\" title=\"Title\">ref</a> " +
+				"<a href=\"/url\" title=\"Title\">ref</a></p>\n",
+		},
+		{"[x]: /a\n\n[X]", "<p><a href=\"/a\">X</a></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestLinkDestinationsAndTitles(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[a](/u(1)(2) 'T')", "<p><a href=\"/u(1)(2)\" title=\"T\">a</a></p>\n"},
+		{"[a](</my url>)", "<p><a href=\"/my%20url\">a</a></p>\n"},
+		{"[a](<b)c>)", "<p><a href=\"b)c\">a</a></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestFootnotes(t *testing.T) {
+	input := "Note[^1] again[^1].\n\n[^1]: The *note*."
+	want := "<p>Note<sup class=\"footnote-ref\"><a href=\"#fn-1\" id=\"fnref-1\">1</a></sup> again" +
+		"<sup class=\"footnote-ref\"><a href=\"#fn-1\" id=\"fnref-1-2\">1</a></sup>.</p>\n" +
+		"<section class=\"footnotes\"><ol><li id=\"fn-1\"><p>The <i>note</i>. " +
+		"<a class=\"footnote-backref\" href=\"#fnref-1\">↩</a> " +
+		"<a class=\"footnote-backref\" href=\"#fnref-1-2\">↩</a></p></li></ol></section>\n"
+
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestExtendedAutolinksParseInLinearTime(t *testing.T) {
+	options := NewOptions()
+	options.Autolinks = true
+
+	short := parseTimeWith(strings.Repeat("www.a.com ", 1250), options)
+	long := parseTimeWith(strings.Repeat("www.a.com ", 10000), options)
+	if long > time.Second || long > 24*short {
+		t.Errorf("links took %v repeated 1250 times but %v repeated 10000 times", short, long)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"os"
+	"flag"
 )
 
 func main() {
-	args := os.Args[1:]
+	options := NewOptions()
+	options.registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	args := flag.Args()
 	if len(args) == 0 {
-		eval()
+		eval(options)
 	} else {
-		files := NewFiles(args)
+		files := NewFiles(args, options)
 		files.createFiles()
 	}
 }
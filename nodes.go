@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -12,31 +14,60 @@ import (
 type NodeType string
 
 const (
+	Anchor        NodeType = "anchor"
+	Autolink      NodeType = "autolink"
+	Checkbox      NodeType = "input"
 	Code          NodeType = "code"
+	CodeBlock     NodeType = "pre"
+	Delimiter     NodeType = "delimiter"
+	Entity        NodeType = "entity"
+	ExtendedLink  NodeType = "extended-autolink"
 	Image         NodeType = "img"
 	Link          NodeType = "a"
 	Bold          NodeType = "b"
 	Div           NodeType = "div"
+	Highlight     NodeType = "mark"
+	HtmlBlock     NodeType = "html-block"
+	HtmlInline    NodeType = "html-inline"
 	Heading1      NodeType = "h1"
 	Heading2      NodeType = "h2"
 	Heading3      NodeType = "h3"
 	Heading4      NodeType = "h4"
 	Heading5      NodeType = "h5"
 	Heading6      NodeType = "h6"
+	IndentedCode  NodeType = "indented-code"
 	Italic        NodeType = "i"
+	LineBreak     NodeType = "br"
+	LineEnd       NodeType = "line-end"
 	ListElement   NodeType = "li"
+	Nav           NodeType = "nav"
 	OrderedList   NodeType = "ol"
 	Paragraph     NodeType = "p"
 	Quote         NodeType = "blockquote"
+	Strikethrough NodeType = "del"
+	Subscript     NodeType = "sub"
+	Superscript   NodeType = "sup"
+	Table         NodeType = "table"
+	TableBody     NodeType = "tbody"
+	TableCell     NodeType = "td"
+	TableHead     NodeType = "thead"
+	TableHeader   NodeType = "th"
+	TableRow      NodeType = "tr"
+	ThematicBreak NodeType = "hr"
 	UnorderedList NodeType = "ul"
 	PlainText     NodeType = ""
 	Escaped       NodeType = "escaped"
+	Footnote      NodeType = "footnote"
+	FootnoteRef   NodeType = "footnote-ref"
+	FootnoteBack  NodeType = "footnote-backref"
+	Section       NodeType = "section"
 )
 
 // ----------------------------------------------------------------------------------------------------------------
 
 type HtmlNode interface {
 	toHtml() string
+	toText() string
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -65,33 +96,89 @@ func NewLeafNode(value *string, nodeType *NodeType, properties *map[string]strin
 }
 
 func (l *LeafNode) propertiesToHtml() string {
-	var out bytes.Buffer
-
-	for key, value := range l.properties {
-		out.WriteString(fmt.Sprintf(" %v=%v", key, value))
-	}
-
-	return out.String()
+	return attributesToHtml(l.properties)
 }
 
+// Values are text and are escaped on the way out.
 func (l *LeafNode) toHtml() string {
 	switch l.nodeType {
-	case Code, Link:
-		return fmt.Sprintf("<%v%v>%v</%v>", l.nodeType, l.propertiesToHtml(), l.value, l.nodeType)
+	case Code:
+		return fmt.Sprintf("<%v%v>%v</%v>", l.nodeType, l.propertiesToHtml(), escapeHtml(l.value), l.nodeType)
+	case CodeBlock:
+		return fmt.Sprintf("<%v><code%v>%v</code></%v>", l.nodeType, l.propertiesToHtml(), escapeHtml(l.value), l.nodeType)
+	case Checkbox, ThematicBreak:
+		return fmt.Sprintf("<%v%v>", l.nodeType, l.propertiesToHtml())
 	case Image:
 		return fmt.Sprintf("<%v%v/>", l.nodeType, l.propertiesToHtml())
+	case HtmlBlock, HtmlInline:
+		return l.value
+	case LineBreak:
+		return fmt.Sprintf("<%v>\n", l.nodeType)
+	case FootnoteRef:
+		return fmt.Sprintf("<sup class=\"footnote-ref\"><a%v>%v</a></sup>", l.propertiesToHtml(), escapeHtml(l.value))
+	case Anchor, FootnoteBack:
+		return fmt.Sprintf("<a%v>%v</a>", l.propertiesToHtml(), escapeHtml(l.value))
+	default:
+		return escapeHtml(l.value)
+	}
+}
+
+func (l *LeafNode) toText() string {
+	switch l.nodeType {
+	case Image:
+		return l.properties["alt"]
+	case Anchor, Checkbox, FootnoteBack, FootnoteRef, HtmlBlock, HtmlInline, ThematicBreak:
+		return ""
+	case LineBreak:
+		return "\n"
 	default:
 		return l.value
 	}
 }
 
+// ----------------------------------------------------------------------------------------------------------------
+// DelimiterNode
+// ----------------------------------------------------------------------------------------------------------------
+
+// A run of emphasis characters. It only exists while a block is being parsed, after which the characters it has left
+// become plain text.
+type DelimiterNode struct {
+	char     byte
+	count    int
+	length   int
+	canOpen  bool
+	canClose bool
+}
+
+func NewDelimiterNode(char byte, length int, canOpen, canClose bool) *DelimiterNode {
+	return &DelimiterNode{
+		char:     char,
+		count:    length,
+		length:   length,
+		canOpen:  canOpen,
+		canClose: canClose,
+	}
+}
+
+func (d *DelimiterNode) toHtml() string {
+	return d.toText()
+}
+
+func (d *DelimiterNode) toText() string {
+	return strings.Repeat(string(d.char), d.count)
+}
+
 // ----------------------------------------------------------------------------------------------------------------
 // ParentNode
 // ----------------------------------------------------------------------------------------------------------------
 
+// Task and checked are only set on list items that start with a task marker.
 type ParentNode struct {
 	nodeType   NodeType
 	childNodes []HtmlNode
+	properties map[string]string
+	task       bool
+	checked    bool
 }
 
 func NewParentNode(nodeType *NodeType, childNodes ...HtmlNode) *ParentNode {
@@ -101,11 +188,77 @@ func NewParentNode(nodeType *NodeType, childNodes ...HtmlNode) *ParentNode {
 	}
 }
 
+func (p *ParentNode) addProperty(key, value string) {
+	if p.properties == nil {
+		p.properties = make(map[string]string)
+	}
+	p.properties[key] = value
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *ParentNode) markTask(checked bool) {
+	p.task = true
+	p.checked = checked
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Counts the task list items below the node so tools can report on checklists.
+func (p *ParentNode) countTasks() (total int, completed int) {
+	for _, child := range p.childNodes {
+		node, ok := child.(*ParentNode)
+		if !ok {
+			continue
+		}
+
+		if node.task {
+			total++
+			if node.checked {
+				completed++
+			}
+		}
+		childTotal, childCompleted := node.countTasks()
+		total += childTotal
+		completed += childCompleted
+	}
+
+	return total, completed
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Whether a link or footnote reference sits anywhere below the node. Html does not allow links inside links.
+func (p *ParentNode) holdsLink() bool {
+	for _, child := range p.childNodes {
+		switch node := child.(type) {
+		case *LeafNode:
+			if node.nodeType == FootnoteRef {
+				return true
+			}
+		case *ParentNode:
+			if node.nodeType == Link || node.holdsLink() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *ParentNode) propertiesToHtml() string {
+	return attributesToHtml(p.properties)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
 func (p *ParentNode) toHtml() string {
 	var out bytes.Buffer
 
 	if p.nodeType != PlainText {
-		out.WriteString(fmt.Sprintf("<%v>", p.nodeType))
+		out.WriteString(fmt.Sprintf("<%v%v>", p.nodeType, p.propertiesToHtml()))
 	}
 
 	for _, child := range p.childNodes {
@@ -118,4 +271,86 @@ func (p *ParentNode) toHtml() string {
 	return out.String()
 }
 
+func (p *ParentNode) toText() string {
+	var out bytes.Buffer
+
+	for _, child := range p.childNodes {
+		out.WriteString(child.toText())
+	}
+
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
+
+func isHeading(nodeType NodeType) bool {
+	switch nodeType {
+	case Heading1, Heading2, Heading3, Heading4, Heading5, Heading6:
+		return true
+	default:
+		return false
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Attributes are written in name order so the same document always produces the same html. Empty values are
+// written as boolean attributes and URLs are percent encoded before being escaped.
+func attributesToHtml(properties map[string]string) string {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out bytes.Buffer
+
+	for _, key := range keys {
+		if properties[key] == "" {
+			out.WriteString(fmt.Sprintf(" %v", key))
+			continue
+		}
+		value := properties[key]
+		if key == "href" || key == "src" {
+			value = encodeUrl(value)
+		}
+		out.WriteString(fmt.Sprintf(" %v=\"%v\"", key, escapeHtml(value)))
+	}
+
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Percent encodes the characters that may not appear in a URL, leaving existing %XX escapes alone.
+func encodeUrl(url string) string {
+	var out bytes.Buffer
+
+	for index := 0; index < len(url); index++ {
+		char := url[index]
+		switch {
+		case char == '%' && index+2 < len(url) && isHexDigit(url[index+1]) && isHexDigit(url[index+2]):
+			out.WriteByte(char)
+		case char < 128 && (isAlphaNumeric(char) || strings.IndexByte("-._~:/?#[]@!$&'()*+,;=", char) != -1):
+			out.WriteByte(char)
+		default:
+			out.WriteString(fmt.Sprintf("%%%02X", char))
+		}
+	}
+
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func escapeHtml(text string) string {
+	return htmlEscaper.Replace(text)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+
 // ----------------------------------------------------------------------------------------------------------------
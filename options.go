@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// Switches for the syntax extensions the parser understands.
+// ----------------------------------------------------------------------------------------------------------------
+
+type Options struct {
+	IndentedCode   bool
+	Strikethrough  bool
+	Highlight      bool
+	Superscript    bool
+	Subscript      bool
+	Footnotes      bool
+	Autolinks      bool
+	HeadingAnchors bool
+	Toc            bool
+	TocMinDepth    int
+	TocMaxDepth    int
+	SoftBreak      string
+	SafeMode       bool
+	SafeSchemes    []string
+	StripHtml      bool
+	Sanitize       bool
+	Template       string
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Object creation
+// ----------------------------------------------------------------------------------------------------------------
+
+func NewOptions() *Options {
+	return &Options{
+		IndentedCode:  true,
+		Strikethrough: true,
+		Highlight:     true,
+		Superscript:   true,
+		Subscript:     true,
+		Footnotes:     true,
+		SoftBreak:     "newline",
+		TocMinDepth:   1,
+		TocMaxDepth:   6,
+		SafeSchemes:   []string{"http", "https", "mailto"},
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Methods
+// ----------------------------------------------------------------------------------------------------------------
+
+func (o *Options) registerFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.IndentedCode, "indented-code", o.IndentedCode, "treat lines indented by four spaces as code")
+	flags.BoolVar(&o.Strikethrough, "strikethrough", o.Strikethrough, "parse ~~strikethrough~~")
+	flags.BoolVar(&o.Highlight, "highlight", o.Highlight, "parse ==highlight==")
+	flags.BoolVar(&o.Superscript, "superscript", o.Superscript, "parse ^superscript^")
+	flags.BoolVar(&o.Subscript, "subscript", o.Subscript, "parse ~subscript~")
+	flags.BoolVar(&o.Footnotes, "footnotes", o.Footnotes, "parse [^1] footnotes")
+	flags.BoolVar(&o.Autolinks, "autolink", o.Autolinks, "link bare www., http(s):// and email addresses")
+	flags.BoolVar(&o.HeadingAnchors, "heading-anchors", o.HeadingAnchors, "add a link to itself inside each heading")
+	flags.BoolVar(&o.Toc, "toc", o.Toc, "fill the {{ TOC }} slot of the page with a table of contents")
+	flags.IntVar(&o.TocMinDepth, "toc-min-depth", o.TocMinDepth, "highest heading level listed in a table of contents")
+	flags.IntVar(&o.TocMaxDepth, "toc-max-depth", o.TocMaxDepth, "lowest heading level listed in a table of contents")
+	flags.Func("soft-break", "render line endings inside paragraphs as newline, br or space", func(value string) error {
+		switch value {
+		case "newline", "br", "space":
+			o.SoftBreak = value
+			return nil
+		default:
+			return fmt.Errorf("unknown soft break %q", value)
+		}
+	})
+	flags.BoolVar(&o.SafeMode, "safe", o.SafeMode, "drop link and image urls whose scheme is not allowed")
+	flags.Func("safe-schemes", "comma separated url schemes allowed in safe mode", func(value string) error {
+		o.SafeSchemes = strings.Split(value, ",")
+		return nil
+	})
+	flags.BoolVar(&o.StripHtml, "strip-html", o.StripHtml, "remove raw html in safe mode instead of escaping it")
+	flags.BoolVar(&o.Sanitize, "sanitize", o.Sanitize, "filter the generated html through a tag allowlist")
+	flags.StringVar(&o.Template, "template", o.Template, "html file used as the page template instead of the built in one")
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns nil when sanitizing is switched off.
+func (o *Options) sanitizer() *Sanitizer {
+	if !o.Sanitize {
+		return nil
+	}
+	return NewSanitizer(o.SafeSchemes)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
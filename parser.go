@@ -1,6 +1,14 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 // ----------------------------------------------------------------------------------------------------------------
 
@@ -8,6 +16,9 @@ const EOF rune = 0
 const PeekOnce = 0
 const PeekTwice = 1
 
+// Spans nested deeper than this are left as text, which keeps the parser's recursion in check on hostile input.
+const MaxSpanDepth = 100
+
 // ----------------------------------------------------------------------------------------------------------------
 // Parser Types.
 // ----------------------------------------------------------------------------------------------------------------
@@ -20,27 +31,98 @@ type Parser struct {
 	peek         int
 	ch           rune
 	parsingFuncs map[NodeType]ParseFunc
+	options      *Options
+	document     *Document
+	spans        map[spanScan]*parsedSpan
+	unclosed     map[spanScan]bool
+	depth        int
+}
+
+// Looking through a span for its closer only depends on where the look starts, the kind of span and whether bare urls
+// are being linked. Each span is parsed once and every place where a look ran into the end of the input is kept, so
+// unclosed openers do not parse the rest of the input over and over again.
+type spanScan struct {
+	position  int
+	nodeType  NodeType
+	autolinks bool
+}
+
+type parsedSpan struct {
+	node *ParentNode
+	end  int
+}
+
+// A delimiter run in the linked list processEmphasis works through, with the index of its node.
+type delimiterEntry struct {
+	delimiter *DelimiterNode
+	node      int
+	previous  int
+	next      int
+}
+
+// Closers of the same character and length modulo three, which can open as well or not, share where their search
+// for an opener stops.
+type openersBottomKey struct {
+	char    byte
+	canOpen bool
+	modulo  int
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func NewParser(input *string) *Parser {
+func NewParser(input *string, document *Document) *Parser {
+	options := document.options
 	newParser := &Parser{
 		input:        *input,
 		current:      0,
 		peek:         0,
 		parsingFuncs: make(map[NodeType]ParseFunc),
+		options:      options,
+		document:     document,
+		spans:        make(map[spanScan]*parsedSpan),
+		unclosed:     make(map[spanScan]bool),
 	}
 	newParser.readChar()
 
-	newParser.registerFunc(Bold, newParser.boldItalicNode)
-	newParser.registerFunc(Italic, newParser.boldItalicNode)
+	newParser.registerFunc(Delimiter, newParser.parseDelimiterRun)
 	newParser.registerFunc(Image, func() HtmlNode { nodeType := Image; return newParser.parseImageLink(&nodeType) })
 	newParser.registerFunc(Link, func() HtmlNode { nodeType := Link; return newParser.parseImageLink(&nodeType) })
 	newParser.registerFunc(Code, newParser.parseCode)
-	newParser.registerFunc(UnorderedList, newParser.parseUnorderedList)
-	newParser.registerFunc(OrderedList, newParser.parseOrderedList)
+	newParser.registerFunc(CodeBlock, newParser.parseCodeBlock)
+	newParser.registerFunc(UnorderedList, newParser.parseList)
+	newParser.registerFunc(OrderedList, newParser.parseList)
+	newParser.registerFunc(Quote, newParser.parseQuote)
+	newParser.registerFunc(Table, newParser.parseTable)
+	newParser.registerFunc(ThematicBreak, newParser.parseThematicBreak)
 	newParser.registerFunc(Escaped, newParser.parseEscaped)
+	newParser.registerFunc(Entity, newParser.parseEntity)
+	newParser.registerFunc(HtmlBlock, newParser.parseHtmlBlock)
+	newParser.registerFunc(HtmlInline, newParser.parseHtmlInline)
+	newParser.registerFunc(Autolink, newParser.parseAutolink)
+	newParser.registerFunc(LineEnd, newParser.parseLineEnd)
+
+	if options.IndentedCode {
+		newParser.registerFunc(IndentedCode, newParser.parseIndentedCode)
+	}
+	if options.Strikethrough {
+		newParser.registerFunc(Strikethrough, newParser.parseStrikethrough)
+	}
+	if options.Highlight {
+		newParser.registerFunc(Highlight, newParser.parseHighlight)
+	}
+	if options.Superscript {
+		newParser.registerFunc(Superscript, newParser.parseSuperscript)
+	}
+	if options.Subscript {
+		newParser.registerFunc(Subscript, newParser.parseSubscript)
+	}
+	if options.Footnotes {
+		newParser.registerFunc(Footnote, newParser.parseFootnote)
+		newParser.registerFunc(FootnoteRef, newParser.parseFootnoteRef)
+	}
+	if options.Autolinks {
+		newParser.registerFunc(ExtendedLink, newParser.parseExtendedLink)
+	}
 
 	return newParser
 }
@@ -50,114 +132,512 @@ func NewParser(input *string) *Parser {
 // ----------------------------------------------------------------------------------------------------------------
 
 func (p *Parser) parse() HtmlNode {
+	if isTocPlaceholder(p.input) {
+		return NewTocNode(p.document)
+	}
+
 	rootType := p.blockType()
+	switch rootType {
+	case CodeBlock, Footnote, HtmlBlock, IndentedCode, OrderedList, UnorderedList, Quote, Table, ThematicBreak:
+		return p.parsingFuncs[rootType]()
+	case Paragraph:
+		if node := p.parseDefinitions(); node != nil {
+			return node
+		}
+		if node := p.parseInterrupted(); node != nil {
+			return node
+		}
+		p.input = strings.TrimRight(p.input, " \t")
+	}
 	p.consumeBlockHeading(rootType)
+	if isHeading(rootType) {
+		return p.parseHeading(rootType, atxContent(p.input[p.current:]))
+	}
 
-	start := p.current
-	children := make([]HtmlNode, 0)
+	return p.parseInline(&rootType)
+}
 
-	for p.ch != EOF {
-		p.buildNestedorRead(&start, &children)
-	}
+// ----------------------------------------------------------------------------------------------------------------
 
-	if start < p.current {
-		value := p.input[start:p.peek]
-		nodeType := PlainText
-		children = append(children, NewLeafNode(&value, &nodeType, nil))
-	}
+// <https://example.com> and <someone@example.com> link to themselves.
+func (p *Parser) parseAutolink() HtmlNode {
+	end := p.autolinkEnd()
+	text := p.input[p.current+1 : end-1]
+	p.readTo(end)
 
-	return NewParentNode(&rootType, children...)
+	if isEmailAddress(text) {
+		return p.newLink(text, "mailto:"+text)
+	}
+	return p.newLink(text, text)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseChildren(identSize *int, breakCondition func() bool, nodeType *NodeType) HtmlNode {
+func (p *Parser) parseChildren(identSize *int, breakCondition func() bool, nodeType *NodeType) *ParentNode {
 	functionStart := p.current
+	autolinks := p.registered(ExtendedLink) == ExtendedLink
+	if span, ok := p.spans[spanScan{functionStart, *nodeType, autolinks}]; ok {
+		p.readTo(span.end)
+		return span.node
+	}
+
 	p.readX(identSize)
+	openerEnd := p.current
 	start := p.current
 	children := make([]HtmlNode, 0)
+	scanned := make([]spanScan, 0)
+	unclosed := p.depth >= MaxSpanDepth
 
-	for p.ch != EOF {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	for !unclosed && p.ch != EOF {
+		scan := spanScan{p.current, *nodeType, autolinks}
+		if p.unclosed[scan] {
+			unclosed = true
+			break
+		}
 		if breakCondition() {
 			break
 		}
+		scanned = append(scanned, scan)
 		p.buildNestedorRead(&start, &children)
 	}
 
-	if p.checkUnterminatedExceptions(nodeType) {
-		value := p.input[functionStart:p.peek]
-		nodeType := PlainText
+	// Without a closer the opening characters are plain text and parsing carries on straight after them.
+	if unclosed || p.checkUnterminatedExceptions(nodeType) {
+		for _, scan := range scanned {
+			p.unclosed[scan] = true
+		}
+		p.readTo(openerEnd)
+		value := p.input[functionStart:openerEnd]
+		textType := PlainText
 
-		return NewParentNode(&nodeType,
-			NewLeafNode(&value, &nodeType, nil))
+		return p.keepSpan(functionStart, nodeType, autolinks, NewParentNode(&textType,
+			NewLeafNode(&value, &textType, nil)))
 	}
 
-	offset := 0
-	if *nodeType == Paragraph {
-		offset++
-	}
 	if start < p.current {
-		value := p.input[start : p.current+offset]
+		value := p.input[start:p.current]
 		nodeType := PlainText
 		children = append(children, NewLeafNode(&value, &nodeType, nil))
 	}
 
 	p.readX(identSize)
 
-	return NewParentNode(nodeType, children...)
+	return p.keepSpan(functionStart, nodeType, autolinks, NewParentNode(nodeType, p.processEmphasis(children)...))
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseBold() HtmlNode {
-	identSize := 2
+// A code span closes on a backtick run of the same length as the one that opened it. Its content is not parsed and
+// an unmatched run is kept as literal backticks.
+func (p *Parser) parseCode() HtmlNode {
+	openStart := p.current
+	openEnd := p.backtickRunEnd(openStart)
+	runLength := openEnd - openStart
+
+	for index := openEnd; index < len(p.input); {
+		if p.input[index] != '`' {
+			index++
+			continue
+		}
 
-	breakCondition := func() bool {
-		return p.ch == '*' && p.peekCharX(PeekOnce) == '*'
+		runEnd := p.backtickRunEnd(index)
+		if runEnd-index != runLength {
+			index = runEnd
+			continue
+		}
+
+		value := strings.ReplaceAll(p.input[openEnd:index], "\n", " ")
+		if len(value) > 1 && value[0] == ' ' && value[len(value)-1] == ' ' && strings.Trim(value, " ") != "" {
+			value = value[1 : len(value)-1]
+		}
+		p.readTo(runEnd)
+
+		nodeType := Code
+		return NewLeafNode(&value, &nodeType, nil)
 	}
 
-	childType := Bold
-	return p.parseChildren(&identSize, breakCondition, &childType)
+	p.readTo(openEnd)
+
+	value := p.input[openStart:openEnd]
+	nodeType := PlainText
+	return NewLeafNode(&value, &nodeType, nil)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseCode() HtmlNode {
-	identSize := 3
+// Fenced code is taken line by line and kept verbatim. Anything after the closing fence is parsed as its own block.
+func (p *Parser) parseCodeBlock() HtmlNode {
+	lines := p.remainingLines()
+	fence := openingFence(lines[0])
+
+	var content bytes.Buffer
+	consumed := 1
+	for _, line := range lines[1:] {
+		consumed++
+		if fence.isClosedBy(line) {
+			break
+		}
+		content.WriteString(fence.stripIndent(line) + "\n")
+	}
+
+	value := content.String()
+	nodeType := CodeBlock
+	var properties *map[string]string
+	if language := fence.language(); language != "" {
+		properties = &map[string]string{"class": "language-" + language}
+	}
+	codeNode := NewLeafNode(&value, &nodeType, properties)
+
+	return p.withRemaining(codeNode, lines[consumed:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Link definitions at the start of a paragraph are added to the document and leave nothing behind. Whatever follows
+// them is parsed as a block of its own.
+func (p *Parser) parseDefinitions() HtmlNode {
+	start := p.current
+	for {
+		label, definition, end := linkDefinition(p.input[p.current:])
+		if definition == nil {
+			break
+		}
+		p.document.define(label, definition)
+		p.readTo(p.current + end)
+	}
+
+	if p.current == start {
+		return nil
+	}
+
+	rest := p.input[p.current:]
+	if isBlank(rest) {
+		value := ""
+		nodeType := PlainText
+		return NewLeafNode(&value, &nodeType, nil)
+	}
+	return NewParser(&rest, p.document).parse()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A run of * or _ is left as a delimiter until processEmphasis pairs it up. Whether it can open or close emphasis
+// depends on the characters either side of the run.
+func (p *Parser) parseDelimiterRun() HtmlNode {
+	char := p.input[p.current]
+	start := p.current
+	end := start
+	for end < len(p.input) && p.input[end] == char {
+		end++
+	}
+
+	before := p.peekPreviousX(PeekTwice)
+	after := p.readFromIndex(&end)
+
+	leftFlanking := !p.isWhitespace(after) &&
+		(!p.isPunctuation(after) || p.isWhitespace(before) || p.isPunctuation(before))
+	rightFlanking := !p.isWhitespace(before) &&
+		(!p.isPunctuation(before) || p.isWhitespace(after) || p.isPunctuation(after))
+
+	canOpen, canClose := leftFlanking, rightFlanking
+	if char == '_' {
+		canOpen = leftFlanking && (!rightFlanking || p.isPunctuation(before))
+		canClose = rightFlanking && (!leftFlanking || p.isPunctuation(after))
+	}
+
+	p.readTo(end)
+
+	return NewDelimiterNode(char, end-start, canOpen, canClose)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// ~~text~~ and ==text== style spans. The text may not start or end with whitespace.
+func (p *Parser) parseDoubleDelimited(char rune, nodeType NodeType) HtmlNode {
+	identSize := 2
+
+	if p.isWhitespace(p.peekCharX(PeekTwice)) {
+		p.readX(&identSize)
+		value := string([]rune{char, char})
+		textType := PlainText
+		return NewLeafNode(&value, &textType, nil)
+	}
 
 	breakCondition := func() bool {
-		return p.ch == '`' && p.peekCharX(PeekOnce) == '`' && p.peekCharX(PeekTwice) == '`'
+		return p.ch == char && p.peekCharX(PeekOnce) == char && !p.isWhitespace(p.peekPreviousX(PeekTwice))
 	}
 
-	childType := Code
-	return p.parseChildren(&identSize, breakCondition, &childType)
+	return p.parseChildren(&identSize, breakCondition, &nodeType)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
+// Named and numeric character references such as &copy; or &#123; become the character they stand for. Anything
+// else starting with & is left as it is.
+func (p *Parser) parseEntity() HtmlNode {
+	value := "&"
+	end := p.entityEnd()
+
+	if end != -1 {
+		reference := p.input[p.current:end]
+		if decoded := html.UnescapeString(reference); decoded != reference {
+			value = decoded
+		} else {
+			end = -1
+		}
+	}
+	if end == -1 {
+		p.readChar()
+	} else {
+		p.readTo(end)
+	}
+
+	nodeType := PlainText
+	return NewLeafNode(&value, &nodeType, nil)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Only ASCII punctuation can be escaped. Before anything else the backslash is kept as it is.
 func (p *Parser) parseEscaped() HtmlNode {
+	value := "\\"
 	p.readChar()
 
-	value := string(p.input[p.current])
+	if p.ch == '\n' {
+		return p.lineBreak(true)
+	}
+	if isAsciiPunctuation(p.ch) {
+		value = string(p.ch)
+		p.readChar()
+	}
 	nodeType := PlainText
-	newLeaf := NewLeafNode(&value, &nodeType, nil)
 
-	p.readChar()
+	return NewLeafNode(&value, &nodeType, nil)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
 
-	return newLeaf
+func (p *Parser) parseHighlight() HtmlNode {
+	return p.parseDoubleDelimited('=', Highlight)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseItalic() HtmlNode {
-	identSize := 1
+// Lines indented by four columns or more, along with the blank lines between them, kept verbatim without the
+// indentation.
+func (p *Parser) parseIndentedCode() HtmlNode {
+	lines := p.remainingLines()
 
-	breakCondition := func() bool {
-		return p.ch == '*' && p.peekCharX(PeekOnce) != '*'
+	end := 0
+	for index, line := range lines {
+		if !isBlank(line) && leadingColumns(line) < 4 {
+			break
+		}
+		if !isBlank(line) {
+			end = index + 1
+		}
+	}
+
+	var content bytes.Buffer
+	for _, line := range lines[:end] {
+		content.WriteString(removeColumns(line, 4) + "\n")
 	}
 
-	childType := Italic
-	return p.parseChildren(&identSize, breakCondition, &childType)
+	value := content.String()
+	nodeType := CodeBlock
+	return p.withRemaining(NewLeafNode(&value, &nodeType, nil), lines[end:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Parses the rest of the input as inline content only, for text whose block has already been decided.
+func (p *Parser) parseInline(nodeType *NodeType) *ParentNode {
+	start := p.current
+	children := make([]HtmlNode, 0)
+
+	for p.ch != EOF {
+		p.buildNestedorRead(&start, &children)
+	}
+
+	if start < p.current {
+		value := p.input[start:p.current]
+		nodeType := PlainText
+		children = append(children, NewLeafNode(&value, &nodeType, nil))
+	}
+
+	return NewParentNode(nodeType, p.processEmphasis(children)...)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseExtendedLink() HtmlNode {
+	length, href := extendedAutolink(p.input[p.current:])
+	text := p.input[p.current : p.current+length]
+	p.readTo(p.current + length)
+
+	return p.newLink(text, href)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The definition's text carries on over indented lines and lazy ones, and is parsed as blocks of its own. It is
+// added to the document and rendered with the other footnotes at the end.
+func (p *Parser) parseFootnote() HtmlNode {
+	lines := p.remainingLines()
+	label, offset := footnoteDefinition(lines[0])
+
+	content := []string{strings.TrimLeft(lines[0][offset:], " \t")}
+	index := 1
+	for ; index < len(lines); index++ {
+		line := lines[index]
+		previousBlank := isBlank(content[len(content)-1])
+
+		if isBlank(line) || leadingColumns(line) >= 4 {
+			content = append(content, removeColumns(line, 4))
+		} else if _, next := footnoteDefinition(line); next == -1 && !previousBlank && !interruptsParagraph(line) {
+			content = append(content, line)
+		} else {
+			break
+		}
+	}
+
+	text := strings.Join(content, "\n")
+	children := make([]HtmlNode, 0)
+	for _, block := range *NewBlocks(&text, p.options).getBlocks() {
+		children = append(children, NewParser(&block, p.document).parse())
+	}
+
+	footnoteType := Footnote
+	p.document.defineFootnote(label, NewParentNode(&footnoteType, children...))
+
+	value := ""
+	nodeType := PlainText
+	return p.withRemaining(NewLeafNode(&value, &nodeType, nil), lines[index:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A [^label] that does not match a footnote definition is read as a link instead.
+func (p *Parser) parseFootnoteRef() HtmlNode {
+	end := labelEnd(p.input, p.current)
+	if end == -1 || !isFootnoteLabel(p.input[p.current+2:end]) {
+		nodeType := Link
+		return p.parseImageLink(&nodeType)
+	}
+
+	footnote := p.document.footnote(p.input[p.current+2 : end])
+	if footnote == nil {
+		nodeType := Link
+		return p.parseImageLink(&nodeType)
+	}
+	p.readTo(end + 1)
+
+	id := p.document.referenceFootnote(footnote)
+	value := fmt.Sprint(footnote.number)
+	nodeType := FootnoteRef
+	properties := map[string]string{
+		"href": fmt.Sprintf("#fn-%v", footnote.number),
+		"id":   id,
+	}
+	return NewLeafNode(&value, &nodeType, &properties)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Headings are given an id to link to, taken from a trailing {#id} or else made from their text. With HeadingAnchors
+// set they also hold a link to themselves.
+func (p *Parser) parseHeading(nodeType NodeType, text string) HtmlNode {
+	id, text := customHeadingId(text)
+	heading := NewParser(&text, p.document).parseInline(&nodeType)
+
+	if id == "" {
+		id = slug(heading.toText())
+	}
+	if id == "" {
+		return heading
+	}
+	id = p.document.uniqueId(id)
+	heading.addProperty("id", id)
+	p.document.addHeading(heading)
+
+	if p.options.HeadingAnchors {
+		value := "#"
+		anchorType := Anchor
+		properties := map[string]string{
+			"href":        "#" + id,
+			"class":       "anchor",
+			"aria-hidden": "true",
+		}
+		heading.childNodes = append([]HtmlNode{NewLeafNode(&value, &anchorType, &properties)}, heading.childNodes...)
+	}
+	return heading
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The block is kept exactly as written, up to the line that closes it.
+func (p *Parser) parseHtmlBlock() HtmlNode {
+	lines := p.remainingLines()
+	kind := htmlBlockStart(lines[0])
+
+	consumed := 0
+	for _, line := range lines {
+		if kind >= 6 && isBlank(line) {
+			break
+		}
+		consumed++
+		if htmlBlockEnds(kind, line) {
+			break
+		}
+	}
+
+	value := strings.Join(lines[:consumed], "\n")
+	return p.withRemaining(p.rawHtml(value, HtmlBlock), lines[consumed:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A < that does not start a tag, comment or other piece of html is plain text.
+func (p *Parser) parseHtmlInline() HtmlNode {
+	end := p.htmlInlineEnd()
+	if end == -1 {
+		value := "<"
+		nodeType := PlainText
+		p.readChar()
+		return NewLeafNode(&value, &nodeType, nil)
+	}
+
+	value := p.input[p.current:end]
+	p.readTo(end)
+	return p.rawHtml(value, HtmlInline)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A paragraph ends where a line starts a block that may interrupt it, and both halves are parsed as blocks of their
+// own. An underline of = or - turns the lines above it into a setext heading instead, which is why it is checked
+// before "---" can be taken for a thematic break.
+func (p *Parser) parseInterrupted() HtmlNode {
+	lines := p.remainingLines()
+
+	for index := 1; index < len(lines); index++ {
+		if level := setextLevel(lines[index]); level > 0 {
+			text := strings.TrimSpace(strings.Join(lines[:index], "\n"))
+			headingType := NodeType(fmt.Sprintf("h%v", level))
+			heading := p.parseHeading(headingType, text)
+			return p.withRemaining(heading, lines[index+1:])
+		}
+
+		if interruptsParagraph(lines[index]) || isTableStart(lines[index:]) {
+			paragraph := strings.Join(lines[:index], "\n")
+			return p.withRemaining(NewParser(&paragraph, p.document).parse(), lines[index:])
+		}
+	}
+
+	return nil
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -171,108 +651,402 @@ func (p *Parser) parseImageLink(nodeType *NodeType) HtmlNode {
 		p.readChar()
 	}
 
+	// Links cannot hold other links.
+	if parseFunc, ok := p.parsingFuncs[ExtendedLink]; ok {
+		delete(p.parsingFuncs, ExtendedLink)
+		defer p.registerFunc(ExtendedLink, parseFunc)
+	}
+
 	breakConditionPrefix := func() bool {
 		return p.ch == ']'
 	}
+	textStart := p.current + 1
 	prefixNode := p.parseChildren(&endReads, breakConditionPrefix, &childType)
-	if p.ch != '(' {
+	if p.peekPreviousX(PeekTwice) != ']' {
 		value := p.input[functionStart:p.current]
 		nodeType := PlainText
 		return NewLeafNode(&value, &nodeType, nil)
 	}
 
-	breakCondtionSrc := func() bool {
-		return p.ch == ')'
+	// Brackets whose text already holds a link are text themselves. Images are fine, they only use the text.
+	if *nodeType == Link && prefixNode.holdsLink() {
+		return p.bracketText(p.input[functionStart:textStart], prefixNode)
+	}
+	if p.ch != '(' {
+		return p.parseReference(nodeType, prefixNode, functionStart, textStart)
+	}
+
+	destination, title, end := p.linkTail()
+	if end == -1 {
+		return p.parseReference(nodeType, prefixNode, functionStart, textStart)
+	}
+	p.readTo(end)
+
+	return p.newImageLink(nodeType, prefixNode, destination, title)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Spaces at the end of a line are dropped. Two or more of them make a hard break.
+func (p *Parser) parseLineEnd() HtmlNode {
+	spaces := 0
+	for p.ch == ' ' {
+		spaces++
+		p.readChar()
+	}
+	return p.lineBreak(spaces >= 2)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseList() HtmlNode {
+	lines := p.remainingLines()
+	first := listMarker(lines[0])
+
+	listType := UnorderedList
+	if first.ordered {
+		listType = OrderedList
+	}
+
+	items := make([][]string, 0)
+	loose := false
+	index := 0
+
+	for index < len(lines) {
+		marker := listMarker(lines[index])
+		if marker == nil || !marker.sameList(first) {
+			break
+		}
+		if len(items) > 0 && isBlank(lines[index-1]) {
+			loose = true
+		}
+
+		item := []string{marker.content(lines[index])}
+		index++
+
+		for index < len(lines) {
+			line := lines[index]
+			previousBlank := isBlank(item[len(item)-1])
+
+			if isBlank(line) {
+				item = append(item, "")
+			} else if leadingColumns(line) >= marker.offset {
+				item = append(item, removeColumns(line, marker.offset))
+			} else if listMarker(line) == nil && !previousBlank && !interruptsParagraph(line) {
+				item = append(item, line)
+			} else {
+				break
+			}
+			index++
+		}
+
+		for len(item) > 1 && isBlank(item[len(item)-1]) {
+			item = item[:len(item)-1]
+		}
+		items = append(items, item)
+	}
+
+	// A blank line inside any one item makes the whole list loose, so every item is split into blocks first.
+	checkboxes := make([]HtmlNode, len(items))
+	checked := make([]bool, len(items))
+	itemBlocks := make([]*Blocks, len(items))
+	for index, item := range items {
+		checkboxes[index], checked[index] = p.parseTaskMarker(&item[0])
+		content := strings.Join(item, "\n")
+		itemBlocks[index] = NewBlocks(&content, p.options)
+		loose = loose || itemBlocks[index].hasBlankBetween()
+	}
+
+	children := make([]HtmlNode, 0, len(items))
+	for index, blocks := range itemBlocks {
+		itemChildren := make([]HtmlNode, 0)
+		for _, block := range *blocks.getBlocks() {
+			child := NewParser(&block, p.document).parse()
+			if !loose {
+				p.tighten(child)
+			}
+			itemChildren = append(itemChildren, child)
+		}
+
+		itemType := ListElement
+		itemNode := NewParentNode(&itemType, itemChildren...)
+		if checkbox := checkboxes[index]; checkbox != nil {
+			itemNode.addProperty("class", "task-list-item")
+			itemNode.markTask(checked[index])
+			p.prependChild(itemNode, checkbox)
+		}
+		children = append(children, itemNode)
+	}
+
+	list := NewParentNode(&listType, children...)
+	if first.ordered && first.number != 1 {
+		list.addProperty("start", strconv.Itoa(first.number))
+	}
+	return p.withRemaining(list, lines[index:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// ^text^ and ~text~ style spans, which follow Pandoc in not allowing unescaped whitespace inside.
+func (p *Parser) parseSingleDelimited(char rune, nodeType NodeType) HtmlNode {
+	identSize := 1
+
+	if !p.closesBeforeWhitespace(char) {
+		p.readChar()
+		value := string(char)
+		textType := PlainText
+		return NewLeafNode(&value, &textType, nil)
+	}
+
+	breakCondition := func() bool {
+		return p.ch == char
+	}
+
+	return p.parseChildren(&identSize, breakCondition, &nodeType)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseStrikethrough() HtmlNode {
+	return p.parseDoubleDelimited('~', Strikethrough)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseSubscript() HtmlNode {
+	return p.parseSingleDelimited('~', Subscript)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseSuperscript() HtmlNode {
+	return p.parseSingleDelimited('^', Superscript)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseThematicBreak() HtmlNode {
+	value := ""
+	nodeType := ThematicBreak
+	return p.withRemaining(NewLeafNode(&value, &nodeType, nil), p.remainingLines()[1:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The quote markers are removed and what is left is parsed as blocks of its own, so quotes can hold lists, code and
+// other quotes. A line without a marker carries on the quote's paragraph when it would not start a block itself.
+func (p *Parser) parseQuote() HtmlNode {
+	lines := p.remainingLines()
+
+	content := make([]string, 0, len(lines))
+	index := 0
+	for ; index < len(lines); index++ {
+		line := lines[index]
+		if isQuoteLine(line) {
+			content = append(content, quoteContent(line))
+		} else if index > 0 && !isBlank(line) && !isBlank(content[index-1]) && !interruptsParagraph(line) {
+			content = append(content, line)
+		} else {
+			break
+		}
+	}
+
+	text := strings.Join(content, "\n")
+	children := make([]HtmlNode, 0)
+	for _, block := range *NewBlocks(&text, p.options).getBlocks() {
+		children = append(children, NewParser(&block, p.document).parse())
+	}
+
+	quoteType := Quote
+	return p.withRemaining(NewParentNode(&quoteType, children...), lines[index:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Resolves [text][label], [label][] and [label] against the document's link definitions. When the label is not defined
+// only the first pair of brackets is used up, as text around their parsed content, so a following [label] can still
+// be a link of its own.
+func (p *Parser) parseReference(nodeType *NodeType, prefixNode *ParentNode, functionStart, textStart int) HtmlNode {
+	label := p.input[textStart : p.current-1]
+	end := p.current
+
+	if labelClose := labelEnd(p.input, p.current); labelClose != -1 {
+		label = p.input[p.current+1 : labelClose]
+		end = labelClose + 1
+	} else if strings.HasPrefix(p.input[p.current:], "[]") {
+		end = p.current + 2
+	}
+
+	definition := p.document.definition(label)
+	if definition == nil {
+		return p.bracketText(p.input[functionStart:textStart], prefixNode)
+	}
+
+	p.readTo(end)
+	return p.newImageLink(nodeType, prefixNode, definition.destination, definition.title)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Cells are padded or cut to the header's width. Rows run until a line starts another block.
+func (p *Parser) parseTable() HtmlNode {
+	lines := p.remainingLines()
+	alignments := tableAlignments(lines[1])
+
+	headType := TableHead
+	head := NewParentNode(&headType, p.parseTableRow(&lines[0], alignments, TableHeader))
+
+	rows := make([]HtmlNode, 0)
+	index := 2
+	for ; index < len(lines); index++ {
+		if isBlank(lines[index]) || interruptsParagraph(lines[index]) {
+			break
+		}
+		rows = append(rows, p.parseTableRow(&lines[index], alignments, TableCell))
+	}
+
+	tableType := Table
+	table := NewParentNode(&tableType, head)
+	if len(rows) > 0 {
+		bodyType := TableBody
+		table.childNodes = append(table.childNodes, NewParentNode(&bodyType, rows...))
+	}
+
+	return p.withRemaining(table, lines[index:])
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) parseTableRow(line *string, alignments []string, cellType NodeType) HtmlNode {
+	cells := splitTableRow(*line)
+	children := make([]HtmlNode, 0, len(alignments))
+
+	for column, alignment := range alignments {
+		text := ""
+		if column < len(cells) {
+			text = strings.ReplaceAll(cells[column], "\\|", "|")
+		}
+
+		cell := NewParser(&text, p.document).parseInline(&cellType)
+		if alignment != "" {
+			cell.addProperty("align", alignment)
+		}
+		children = append(children, cell)
+	}
+
+	rowType := TableRow
+	return NewParentNode(&rowType, children...)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// A list item starting with "[ ]" or "[x]" is a task. The marker is removed from the item's first line and returned
+// as a disabled checkbox, along with whether the task is done.
+func (p *Parser) parseTaskMarker(line *string) (HtmlNode, bool) {
+	if len(*line) < 4 || ((*line)[3] != ' ' && (*line)[3] != '\t') {
+		return nil, false
 	}
 
-	srcNode := p.parseChildren(&endReads, breakCondtionSrc, &childType)
+	properties := map[string]string{
+		"disabled": "",
+		"type":     "checkbox",
+	}
 
-	textNode := p.imageLinkChecks(&functionStart)
-	if textNode != nil {
-		return textNode
+	switch (*line)[:3] {
+	case "[ ]":
+	case "[x]", "[X]":
+		properties["checked"] = ""
+	default:
+		return nil, false
 	}
 
-	switch *nodeType {
-	case Image:
-		value := ""
-		nodeType := Image
-		properties := map[string]string{
-			"alt": prefixNode.toHtml(),
-			"src": srcNode.toHtml(),
-		}
-		return NewLeafNode(&value, &nodeType, &properties)
+	*line = (*line)[3:]
+	value := ""
+	nodeType := Checkbox
+	_, checked := properties["checked"]
+	return NewLeafNode(&value, &nodeType, &properties), checked
+}
 
-	case Link:
-		value := prefixNode.toHtml()
-		nodeType := Link
-		properties := map[string]string{
-			"href": srcNode.toHtml(),
-		}
-		return NewLeafNode(&value, &nodeType, &properties)
+// ----------------------------------------------------------------------------------------------------------------
+// Helper functions.
+// ----------------------------------------------------------------------------------------------------------------
 
-	default:
-		return nil
-	}
+// Extended autolinks only start at the beginning of a word, or straight after an opening parenthesis or emphasis.
+func (p *Parser) atWordStart() bool {
+	previous := p.peekPreviousX(PeekTwice)
+	return p.isWhitespace(previous) || strings.ContainsRune("*_~(", previous)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseOrderedList() HtmlNode {
-	consumeIdent := func() {
-		for p.isDigit(&p.ch) {
-			p.readChar()
-		}
-		remainingIdent := 2
-		p.readX(&remainingIdent)
+// Returns the offset just past the > of an autolink starting at the current <, or -1 when there is not one.
+func (p *Parser) autolinkEnd() int {
+	end := strings.IndexAny(p.input[p.current+1:], "<>")
+	if end == -1 || p.input[p.current+1+end] != '>' {
+		return -1
 	}
-	consumeIdent()
 
-	breakCondition := func() bool {
-		return p.isOrderedIdent()
+	text := p.input[p.current+1 : p.current+1+end]
+	if !isAbsoluteUri(text) && !isEmailAddress(text) {
+		return -1
 	}
-
-	endReads := 0
-	childType := ListElement
-	return p.parseChildren(&endReads, breakCondition, &childType)
+	return p.current + end + 2
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) parseUnorderedList() HtmlNode {
-	identSize := 2
-	p.readX(&identSize)
-
-	breakCondition := func() bool {
-		return p.ch == '-' && p.peekCharX(PeekOnce) == ' '
+func (p *Parser) backtickRunEnd(index int) int {
+	for index < len(p.input) && p.input[index] == '`' {
+		index++
 	}
-
-	endReads := 0
-	childType := ListElement
-	return p.parseChildren(&endReads, breakCondition, &childType)
+	return index
 }
 
 // ----------------------------------------------------------------------------------------------------------------
-// Helper functions.
+
+// Brackets that do not make a link are text, but what is inside them keeps its formatting.
+func (p *Parser) bracketText(opener string, prefixNode *ParentNode) HtmlNode {
+	closer := "]"
+	textType := PlainText
+	children := append([]HtmlNode{NewLeafNode(&opener, &textType, nil)}, prefixNode.childNodes...)
+	return NewParentNode(&textType, append(children, NewLeafNode(&closer, &textType, nil))...)
+}
+
 // ----------------------------------------------------------------------------------------------------------------
 
 func (p *Parser) blockType() NodeType {
-	switch p.ch {
-	case '>':
-		if p.peekCharX(PeekOnce) == ' ' {
-			return Quote
-		}
-	case '-':
-		if p.peekCharX(PeekOnce) == ' ' {
-			return UnorderedList
-		}
-	case '#':
-		return p.headingType()
-	default:
-		if p.isDigit(&p.ch) {
-			if p.isOrderedIdent() {
-				return OrderedList
-			}
+	if p.registered(IndentedCode) == IndentedCode && leadingColumns(p.currentLine()) >= 4 {
+		return IndentedCode
+	}
+
+	if isQuoteLine(p.currentLine()) {
+		return Quote
+	}
+
+	if level := atxLevel(p.currentLine()); level > 0 {
+		return NodeType(fmt.Sprintf("h%v", level))
+	}
+
+	if openingFence(p.currentLine()) != nil {
+		return CodeBlock
+	}
+	if htmlBlockStart(p.currentLine()) > 0 {
+		return HtmlBlock
+	}
+	if isThematicBreak(p.currentLine()) {
+		return ThematicBreak
+	}
+	if isTableStart(p.remainingLines()) {
+		return Table
+	}
+	if _, offset := footnoteDefinition(p.currentLine()); offset != -1 && p.registered(Footnote) == Footnote {
+		return Footnote
+	}
+	if marker := listMarker(p.currentLine()); marker != nil {
+		if marker.ordered {
+			return OrderedList
 		}
+		return UnorderedList
 	}
 
 	return Paragraph
@@ -280,11 +1054,38 @@ func (p *Parser) blockType() NodeType {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) boldItalicNode() HtmlNode {
-	if p.checkBoldNode() {
-		return p.parseBold()
+// Wraps the nodes between each pair of delimiters in its emphasis. A delimiter closes its spans, innermost first,
+// then leaves its unused characters as text and opens the spans it starts, outermost first.
+func (p *Parser) buildEmphasis(nodes []HtmlNode, opens, closes [][]NodeType) []HtmlNode {
+	rootType := PlainText
+	parents := []*ParentNode{NewParentNode(&rootType)}
+
+	for index, node := range nodes {
+		delimiter, ok := node.(*DelimiterNode)
+		if !ok {
+			top := parents[len(parents)-1]
+			top.childNodes = append(top.childNodes, node)
+			continue
+		}
+
+		for range closes[index] {
+			closed := parents[len(parents)-1]
+			parents = parents[:len(parents)-1]
+			top := parents[len(parents)-1]
+			top.childNodes = append(top.childNodes, closed)
+		}
+		if delimiter.count > 0 {
+			value := delimiter.toHtml()
+			nodeType := PlainText
+			top := parents[len(parents)-1]
+			top.childNodes = append(top.childNodes, NewLeafNode(&value, &nodeType, nil))
+		}
+		for opened := len(opens[index]) - 1; opened >= 0; opened-- {
+			parents = append(parents, NewParentNode(&opens[index][opened]))
+		}
 	}
-	return p.parseItalic()
+
+	return parents[0].childNodes
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -294,21 +1095,7 @@ func (p *Parser) buildNestedorRead(start *int, targetSlice *[]HtmlNode) {
 	nodeType := PlainText
 
 	ident := p.isIdent()
-	if ident == Escaped {
-		if *start < p.current {
-			*targetSlice = append(*targetSlice, NewLeafNode(&substring, &nodeType, nil))
-		}
-
-		p.readChar()
-
-		escapedChar := string(p.input[p.current])
-		*targetSlice = append(*targetSlice, NewLeafNode(&escapedChar, &nodeType, nil))
-
-		p.readChar()
-
-		*start = p.current
-
-	} else if ident != PlainText {
+	if ident != PlainText {
 		parseFunc := p.parsingFuncs[ident]
 
 		if *start < p.current {
@@ -324,12 +1111,6 @@ func (p *Parser) buildNestedorRead(start *int, targetSlice *[]HtmlNode) {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) checkBoldNode() bool {
-	return p.ch == '*' && p.peekCharX(PeekOnce) == '*' && p.peekCharX(PeekTwice) != '*'
-}
-
-// ----------------------------------------------------------------------------------------------------------------
-
 func (p *Parser) checkUnterminatedExceptions(nodeType *NodeType) bool {
 	case1 := p.ch == EOF
 	case2 := *nodeType != Quote
@@ -348,11 +1129,15 @@ func (p *Parser) checkUnterminatedExceptions(nodeType *NodeType) bool {
 
 // ----------------------------------------------------------------------------------------------------------------
 
+// Up to three spaces may come before the # of a heading.
 func (p *Parser) consumeBlockHeading(blockType NodeType) {
+	if isHeading(blockType) {
+		for p.ch == ' ' {
+			p.readChar()
+		}
+	}
+
 	switch blockType {
-	case Quote:
-		offset := 2
-		p.readX(&offset)
 	case Heading1:
 		offset := 2
 		p.readX(&offset)
@@ -378,78 +1163,237 @@ func (p *Parser) consumeBlockHeading(blockType NodeType) {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) headingType() NodeType {
-	index := 0
+func (p *Parser) currentLine() string {
+	line := p.input[p.current:]
+	if end := strings.IndexByte(line, '\n'); end != -1 {
+		return line[:end]
+	}
+	return line
+}
 
-	for {
-		current := p.readFromIndex(&index)
-		if current != '#' || current == EOF {
-			break
+// ----------------------------------------------------------------------------------------------------------------
+
+// Pairs the closest usable opener with each closer, left to right, following the CommonMark delimiter algorithm. The
+// delimiters are kept in a linked list and where a search for an opener gave up is remembered for each kind of
+// closer, so no opener is looked at over and over. The emphasis is only built once every pair is known.
+func (p *Parser) processEmphasis(nodes []HtmlNode) []HtmlNode {
+	stack := make([]delimiterEntry, 0)
+	for index, node := range nodes {
+		if delimiter, ok := node.(*DelimiterNode); ok {
+			stack = append(stack, delimiterEntry{delimiter, index, len(stack) - 1, len(stack) + 1})
+		}
+	}
+	if len(stack) == 0 {
+		return nodes
+	}
+	stack[len(stack)-1].next = -1
+
+	remove := func(entry int) {
+		if previous := stack[entry].previous; previous != -1 {
+			stack[previous].next = stack[entry].next
+		}
+		if next := stack[entry].next; next != -1 {
+			stack[next].previous = stack[entry].previous
+		}
+	}
+
+	opens := make([][]NodeType, len(nodes))
+	closes := make([][]NodeType, len(nodes))
+	openersBottom := make(map[openersBottomKey]int)
+
+	for current := 0; current != -1; {
+		closer := stack[current].delimiter
+		if !closer.canClose || closer.count == 0 {
+			current = stack[current].next
+			continue
+		}
+
+		key := openersBottomKey{closer.char, closer.canOpen, closer.length % 3}
+		bottom, ok := openersBottom[key]
+		if !ok {
+			bottom = -1
+		}
+		opener := stack[current].previous
+		for opener > bottom && !p.pairs(stack[opener].delimiter, closer) {
+			opener = stack[opener].previous
+		}
+
+		if opener <= bottom {
+			openersBottom[key] = stack[current].previous
+			next := stack[current].next
+			if !closer.canOpen {
+				remove(current)
+			}
+			current = next
+			continue
+		}
+
+		used := 1
+		nodeType := Italic
+		if stack[opener].delimiter.count >= 2 && closer.count >= 2 {
+			used = 2
+			nodeType = Bold
+		}
+		stack[opener].delimiter.count -= used
+		closer.count -= used
+		opens[stack[opener].node] = append(opens[stack[opener].node], nodeType)
+		closes[stack[current].node] = append(closes[stack[current].node], nodeType)
+
+		// Delimiters between the pair can no longer be used and are left as text.
+		stack[opener].next = current
+		stack[current].previous = opener
+		if stack[opener].delimiter.count == 0 {
+			remove(opener)
+		}
+		if closer.count == 0 {
+			next := stack[current].next
+			remove(current)
+			current = next
 		}
-		index++
 	}
 
-	if index >= 6 {
-		return Heading6
+	return p.buildEmphasis(nodes, opens, closes)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Looks past the opening character for its closer, giving up at the first unescaped whitespace. A doubled character
+// belongs to a ~~ style span rather than closing this one.
+func (p *Parser) closesBeforeWhitespace(char rune) bool {
+	for index := p.current + 1; index < len(p.input); {
+		current, size := utf8.DecodeRuneInString(p.input[index:])
+		switch {
+		case current == '\\':
+			_, escapedSize := utf8.DecodeRuneInString(p.input[index+size:])
+			size += escapedSize
+		case current == char:
+			next := index + size
+			return index > p.current+1 && p.readFromIndex(&next) != char
+		case p.isWhitespace(current):
+			return false
+		}
+		index += size
 	}
-	return NodeType(fmt.Sprintf("h%v", index))
+	return false
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) imageLinkChecks(functionStart *int) HtmlNode {
-	subString := p.input[*functionStart:p.peek]
-	nodeType := PlainText
+// Returns the offset just past the ; of a well formed entity reference starting at the current &, or -1.
+func (p *Parser) entityEnd() int {
+	index := p.current + 1
+	maxLength := 31
+	isValid := isAlphaNumeric
 
-	if p.ch == EOF {
-		if p.peekPreviousX(PeekOnce) != ')' {
-			return NewLeafNode(&subString, &nodeType, nil)
-		}
-	} else {
-		if p.peekPreviousX(PeekTwice) != ')' {
-			return NewLeafNode(&subString, &nodeType, nil)
+	if p.readFromIndex(&index) == '#' {
+		index++
+		maxLength = 7
+		isValid = isDigit
+		if next := p.readFromIndex(&index); next == 'x' || next == 'X' {
+			index++
+			maxLength = 6
+			isValid = isHexDigit
 		}
 	}
 
-	return nil
+	start := index
+	for index < len(p.input) && index-start < maxLength && isValid(p.input[index]) {
+		index++
+	}
+
+	if index == start || p.readFromIndex(&index) != ';' {
+		return -1
+	}
+	return index + 1
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) isDigit(ch *rune) bool {
-	return *ch >= '0' && *ch <= '9'
+// ----------------------------------------------------------------------------------------------------------------
+
+// Returns the offset just past the end of the html starting at the current <, or -1 when it is not well formed.
+func (p *Parser) htmlInlineEnd() int {
+	rest := p.input[p.current:]
+	closing := func(suffix string, minimum int) int {
+		end := strings.Index(rest[minimum:], suffix)
+		if end == -1 {
+			return -1
+		}
+		return p.current + minimum + end + len(suffix)
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "<!--"):
+		if strings.HasPrefix(rest, "<!-->") || strings.HasPrefix(rest, "<!--->") {
+			return p.current + strings.IndexByte(rest, '>') + 1
+		}
+		return closing("-->", 4)
+	case strings.HasPrefix(rest, "<![CDATA["):
+		return closing("]]>", 9)
+	case strings.HasPrefix(rest, "<?"):
+		return closing("?>", 2)
+	case len(rest) > 2 && rest[1] == '!' && isAlphaNumeric(rest[2]) && !isDigit(rest[2]):
+		return closing(">", 2)
+	}
+
+	if tag, end := scanTag(rest, 0); tag != nil {
+		return p.current + end
+	}
+	return -1
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
 func (p *Parser) isIdent() NodeType {
 	switch p.ch {
-	case '*':
-		if p.peekCharX(PeekOnce) == '*' {
-			return Bold
-		}
-		return Italic
+	case '*', '_':
+		return Delimiter
 	case '`':
-		if p.peekCharX(PeekOnce) == '`' && p.peekCharX(PeekTwice) == '`' {
-			return Code
-		}
+		return Code
 	case '!':
 		if p.peekCharX(PeekOnce) == '[' {
 			return Image
 		}
 	case '[':
+		if p.peekCharX(PeekOnce) == '^' && p.registered(FootnoteRef) == FootnoteRef {
+			return FootnoteRef
+		}
 		return Link
-	case '-':
-		if p.peekCharX(PeekOnce) == ' ' {
-			return UnorderedList
+	case '~':
+		if p.peekCharX(PeekOnce) == '~' {
+			return p.registered(Strikethrough)
+		}
+		return p.registered(Subscript)
+	case '=':
+		if p.peekCharX(PeekOnce) == '=' {
+			return p.registered(Highlight)
 		}
+	case '^':
+		return p.registered(Superscript)
 	case '\\':
 		return Escaped
-	default:
-		if p.isDigit(&p.ch) {
-			if p.isOrderedIdent() {
-				return OrderedList
-			}
+	case '&':
+		return Entity
+	case ' ':
+		end := p.current
+		for end < len(p.input) && p.input[end] == ' ' {
+			end++
+		}
+		if end < len(p.input) && p.input[end] == '\n' {
+			return LineEnd
+		}
+	case '\n':
+		return LineEnd
+	case '<':
+		if p.autolinkEnd() != -1 {
+			return Autolink
+		}
+		return HtmlInline
+	}
+
+	if p.registered(ExtendedLink) == ExtendedLink && p.atWordStart() {
+		if length, _ := extendedAutolink(p.input[p.current:]); length > 0 {
+			return ExtendedLink
 		}
 	}
 	return PlainText
@@ -457,66 +1401,119 @@ func (p *Parser) isIdent() NodeType {
 
 // ----------------------------------------------------------------------------------------------------------------
 
-func (p *Parser) isOrderedIdent() bool {
-	index := p.current
+// Unicode punctuation and symbols both count, so quotes like « and » flank emphasis the same way " does.
+func (p *Parser) isPunctuation(ch rune) bool {
+	return isAsciiPunctuation(ch) || unicode.In(ch, unicode.P, unicode.S)
+}
 
-	for {
-		char := p.readFromIndex(&index)
-		if !p.isDigit(&char) {
-			break
-		}
-		index++
+// ----------------------------------------------------------------------------------------------------------------
+
+// The start and end of the input count as whitespace, as do Unicode space separators.
+func (p *Parser) isWhitespace(ch rune) bool {
+	return ch == EOF || strings.ContainsRune("\t\n\r\f\v", ch) || unicode.Is(unicode.Zs, ch)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Remembers the span parsed from the position, along with where parsing carried on from, and returns it.
+func (p *Parser) keepSpan(position int, nodeType *NodeType, autolinks bool, node *ParentNode) *ParentNode {
+	p.spans[spanScan{position, *nodeType, autolinks}] = &parsedSpan{node: node, end: p.current}
+	return node
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The rule of three: a run that can both open and close only pairs with a run whose combined length is not a
+// multiple of three, unless both lengths are.
+func (p *Parser) pairs(opener, closer *DelimiterNode) bool {
+	if !opener.canOpen || opener.count == 0 || opener.char != closer.char {
+		return false
 	}
 
-	next := index + 1
-	if p.readFromIndex(&index) == '.' && p.readFromIndex(&next) == ' ' {
-		return true
+	if opener.canClose || closer.canOpen {
+		if (opener.length+closer.length)%3 == 0 && (opener.length%3 != 0 || closer.length%3 != 0) {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
+// Returns the character amount places after the next one, counting in runes rather than bytes.
 func (p *Parser) peekCharX(amount int) rune {
-	offset := p.peek + amount
-	if offset >= len(p.input) {
-		return EOF
+	offset := p.peek
+	for range amount {
+		if offset >= len(p.input) {
+			return EOF
+		}
+		_, size := utf8.DecodeRuneInString(p.input[offset:])
+		offset += size
 	}
-	return rune(p.input[offset])
+	return p.readFromIndex(&offset)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
+// Returns the character amount places before the current one, counting in runes. Reading back past the start of
+// the input gives EOF.
 func (p *Parser) peekPreviousX(amount int) rune {
-	offset := p.current - amount
-	if offset < 0 {
-		return rune(p.input[0])
+	offset := p.current
+	for range amount {
+		if offset <= 0 {
+			return EOF
+		}
+		_, size := utf8.DecodeLastRuneInString(p.input[:offset])
+		offset -= size
 	}
-	if offset >= len(p.input) {
-		return EOF
+	return p.readFromIndex(&offset)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Loose items keep their paragraphs, so the child goes at the start of the first one when there is one.
+func (p *Parser) prependChild(parent *ParentNode, child HtmlNode) {
+	if len(parent.childNodes) > 0 {
+		first, ok := parent.childNodes[0].(*ParentNode)
+		if ok && (first.nodeType == Paragraph || first.nodeType == PlainText) {
+			p.prependChild(first, child)
+			return
+		}
 	}
-	return rune(p.input[offset])
+
+	parent.childNodes = append([]HtmlNode{child}, parent.childNodes...)
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
 func (p *Parser) readChar() {
 	if p.peek >= len(p.input) {
+		p.current = len(p.input)
 		p.ch = EOF
 		return
 	}
 	p.current = p.peek
-	p.ch = rune(p.input[p.current])
-	p.peek++
+	ch, size := utf8.DecodeRuneInString(p.input[p.current:])
+	p.ch = ch
+	p.peek += size
 }
 
 // ----------------------------------------------------------------------------------------------------------------
 
 func (p *Parser) readFromIndex(index *int) rune {
-	if *index >= len(p.input) {
+	if *index < 0 || *index >= len(p.input) {
 		return EOF
 	}
-	return rune(p.input[*index])
+	ch, _ := utf8.DecodeRuneInString(p.input[*index:])
+	return ch
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Moves the parser straight to the byte offset, forwards or back.
+func (p *Parser) readTo(index int) {
+	p.peek = index
+	p.readChar()
 }
 
 // ----------------------------------------------------------------------------------------------------------------
@@ -534,3 +1531,168 @@ func (p *Parser) registerFunc(nodeType NodeType, fn ParseFunc) {
 }
 
 // ----------------------------------------------------------------------------------------------------------------
+
+// Switched off extensions have no parsing function, so their characters stay plain text.
+func (p *Parser) registered(nodeType NodeType) NodeType {
+	if _, ok := p.parsingFuncs[nodeType]; !ok {
+		return PlainText
+	}
+	return nodeType
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) remainingLines() []string {
+	return strings.Split(strings.TrimSuffix(p.input[p.current:], "\n"), "\n")
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Reads the ( destination "title" ) after the text of an inline link. Both parts are optional, the destination may be
+// wrapped in <> and parentheses inside it have to balance. Returns -1 as the end when it is not well formed.
+func (p *Parser) linkTail() (string, string, int) {
+	destinationStart := skipLinkSpace(p.input, p.current+1)
+	destination, end := linkDestination(p.input, destinationStart)
+	if end == -1 {
+		return "", "", -1
+	}
+
+	title := ""
+	if titleStart := skipLinkSpace(p.input, end); titleStart > end {
+		if text, titleEnd := linkTitle(p.input, titleStart); titleEnd != -1 {
+			title = text
+			end = titleEnd
+		}
+	}
+
+	end = skipLinkSpace(p.input, end)
+	if end >= len(p.input) || p.input[end] != ')' {
+		return "", "", -1
+	}
+	return destination, title, end + 1
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Reads the line ending along with the indentation of the next line. A soft break is rendered the way the SoftBreak
+// option asks: as a newline, as a <br> or as a space.
+func (p *Parser) lineBreak(hard bool) HtmlNode {
+	p.readChar()
+	for p.ch == ' ' || p.ch == '\t' {
+		p.readChar()
+	}
+
+	value := "\n"
+	nodeType := PlainText
+	switch {
+	case hard || p.options.SoftBreak == "br":
+		nodeType = LineBreak
+	case p.options.SoftBreak == "space":
+		value = " "
+	}
+	return NewLeafNode(&value, &nodeType, nil)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) newImageLink(nodeType *NodeType, prefixNode *ParentNode, destination, title string) HtmlNode {
+	properties := make(map[string]string)
+	if title != "" {
+		properties["title"] = title
+	}
+
+	switch *nodeType {
+	case Image:
+		value := ""
+		nodeType := Image
+		properties["alt"] = prefixNode.toText()
+		properties["src"] = p.safeUrl(destination)
+		return NewLeafNode(&value, &nodeType, &properties)
+
+	case Link:
+		nodeType := Link
+		link := NewParentNode(&nodeType, prefixNode.childNodes...)
+		properties["href"] = p.safeUrl(destination)
+		for key, value := range properties {
+			link.addProperty(key, value)
+		}
+		return link
+
+	default:
+		return nil
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (p *Parser) newLink(text, href string) HtmlNode {
+	textType := PlainText
+	nodeType := Link
+	link := NewParentNode(&nodeType, NewLeafNode(&text, &textType, nil))
+	link.addProperty("href", p.safeUrl(href))
+	return link
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Raw html passes through untouched, except in safe mode where it is escaped, or removed when StripHtml is set.
+func (p *Parser) rawHtml(value string, nodeType NodeType) HtmlNode {
+	if !p.options.SafeMode {
+		return NewLeafNode(&value, &nodeType, nil)
+	}
+
+	textType := PlainText
+	if p.options.StripHtml {
+		value = ""
+	}
+	text := NewLeafNode(&value, &textType, nil)
+	if nodeType == HtmlBlock && value != "" {
+		paragraphType := Paragraph
+		return NewParentNode(&paragraphType, text)
+	}
+	return text
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// In safe mode a url with a scheme outside the allowlist is replaced by an empty one.
+func (p *Parser) safeUrl(url string) string {
+	if p.options.SafeMode && !isSafeUrl(url, p.options.SafeSchemes) {
+		return ""
+	}
+	return url
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Tight list items hold their paragraphs' text directly rather than wrapping it in <p>.
+func (p *Parser) tighten(node HtmlNode) {
+	parent, ok := node.(*ParentNode)
+	if !ok {
+		return
+	}
+
+	switch parent.nodeType {
+	case Paragraph:
+		parent.nodeType = PlainText
+	case PlainText:
+		for _, child := range parent.childNodes {
+			p.tighten(child)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Lines left over once a block has finished are parsed as the block that follows it.
+func (p *Parser) withRemaining(node HtmlNode, remaining []string) HtmlNode {
+	rest := strings.Join(remaining, "\n")
+	if isBlank(rest) {
+		return node
+	}
+
+	nodeType := PlainText
+	return NewParentNode(&nodeType, node, NewParser(&rest, p.document).parse())
+}
+
+// ----------------------------------------------------------------------------------------------------------------
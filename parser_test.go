@@ -0,0 +1,507 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func renderMarkdown(input string, options *Options) string {
+	return NewDocument(&input, options).toHtml()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// The fastest of three runs, which keeps a garbage collection from deciding a timing test.
+func parseTime(input string) time.Duration {
+	return parseTimeWith(input, NewOptions())
+}
+
+func parseTimeWith(input string, options *Options) time.Duration {
+	fastest := time.Duration(0)
+	for range 3 {
+		start := time.Now()
+		renderMarkdown(input, options)
+		if elapsed := time.Since(start); fastest == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	return fastest
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestFencedCodeBlocks(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"```go\nfmt.Println(\"<x>\")\n```",
+			"<pre><code class=\"language-go\">fmt.Println(&quot;&lt;x&gt;&quot;)\n</code></pre>\n",
+		},
+		{"~~~\n<b>\n~~~", "<pre><code>&lt;b&gt;\n</code></pre>\n"},
+		{"```\nunclosed", "<pre><code>unclosed\n</code></pre>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestNestedLists(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"- a\n  - b\n- c", "<ul><li>a<ul><li>b</li></ul></li><li>c</li></ul>\n"},
+		{"1. a\n   1. b\n2. c", "<ol><li>a<ol><li>b</li></ol></li><li>c</li></ol>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestTables(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"| a | b |\n|:--|--:|\n| 1 | 2 |",
+			"<table><thead><tr><th align=\"left\">a</th><th align=\"right\">b</th></tr></thead>" +
+				"<tbody><tr><td align=\"left\">1</td><td align=\"right\">2</td></tr></tbody></table>\n",
+		},
+		{
+			"| a |\n|---|\n| x \\| y |",
+			"<table><thead><tr><th>a</th></tr></thead><tbody><tr><td>x | y</td></tr></tbody></table>\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestCodeSpans(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"`` a`b ``", "<p><code>a`b</code></p>\n"},
+		{"`a` ``b``` c", "<p><code>a</code> ``b``` c</p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestEmphasis(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"*a **b** c* _d_ __e__ a*b*c snake_case_name",
+			"<p><i>a <b>b</b> c</i> <i>d</i> <b>e</b> a<i>b</i>c snake_case_name</p>\n",
+		},
+		{"***a***", "<p><i><b>a</b></i></p>\n"},
+		{"**a *b** c*", "<p><i><i>a <i>b</i></i> c</i></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestInlineExtensions(t *testing.T) {
+	input := "~~del~~ ==mark== ^sup^ ~sub~"
+	want := "<p><del>del</del> <mark>mark</mark> <sup>sup</sup> <sub>sub</sub></p>\n"
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+
+	options := NewOptions()
+	options.Strikethrough, options.Highlight = false, false
+	options.Superscript, options.Subscript = false, false
+	want = "<p>~~del~~ ==mark== ^sup^ ~sub~</p>\n"
+	if got := renderMarkdown(input, options); got != want {
+		t.Errorf("%q rendered %q with the extensions off, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestThematicBreaksAndSetextHeadings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Title\n=====\n\n***", "<h1 id=\"title\">Title</h1>\n<hr>\n"},
+		{"Title\n---", "<h2 id=\"title\">Title</h2>\n"},
+		{"- - -", "<hr>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestIndentedCode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"    code\n    more", "<pre><code>code\nmore\n</code></pre>\n"},
+		{"\tcode", "<pre><code>code\n</code></pre>\n"},
+		{"para\n    not code", "<p>para\nnot code</p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestUnicodeText(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"é*a*é ünïcödé", "<p>é<i>a</i>é ünïcödé</p>\n"},
+		{"ünï *cödé*", "<p>ünï <i>cödé</i></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestHtmlEscaping(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"AT&amp;T &copy; &#35; &nope; < \"q\"", "<p>AT&amp;T © # &amp;nope; &lt; &quot;q&quot;</p>\n"},
+		{"[a](/u?a=1&b=2 \"x<y\")", "<p><a href=\"/u?a=1&amp;b=2\" title=\"x&lt;y\">a</a></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestRawHtml(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"<div>\n*raw*\n</div>\n\nText <b>inline</b>", "<div>\n*raw*\n</div>\n<p>Text <b>inline</b></p>\n"},
+		{"<!-- c -->\n\nText <span class=\"x\">s</span>", "<!-- c -->\n<p>Text <span class=\"x\">s</span></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestLineBreaks(t *testing.T) {
+	input := "a  \nb\\\nc\nd"
+	want := "<p>a<br>\nb<br>\nc\nd</p>\n"
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+
+	options := NewOptions()
+	options.SoftBreak = "br"
+	want = "<p>a<br>\nb<br>\nc<br>\nd</p>\n"
+	if got := renderMarkdown(input, options); got != want {
+		t.Errorf("%q rendered %q with soft breaks as <br>, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestBlockquotes(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			"> a\nlazy\n> > b\n>\n> - c",
+			"<blockquote><p>a\nlazy</p><blockquote><p>b</p></blockquote><ul><li>c</li></ul></blockquote>\n",
+		},
+		{"> a\n>\n> b", "<blockquote><p>a</p><p>b</p></blockquote>\n"},
+		{"> a\n\n> b", "<blockquote><p>a</p></blockquote>\n<blockquote><p>b</p></blockquote>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestOrderedListStart(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"3) three\n4) four", "<ol start=\"3\"><li>three</li><li>four</li></ol>\n"},
+		{"0. zero", "<ol start=\"0\"><li>zero</li></ol>\n"},
+		{"1. a\n2. b\n\n- x\n+ y", "<ol><li>a</li><li>b</li></ol><ul><li>x</li></ul><ul><li>y</li></ul>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestHeadingIds(t *testing.T) {
+	input := "# Hello *World*\n\n## Hello World\n\n### Custom {#my-id}"
+	want := "<h1 id=\"hello-world\">Hello <i>World</i></h1>\n<h2 id=\"hello-world-1\">Hello World</h2>\n" +
+		"<h3 id=\"my-id\">Custom</h3>\n"
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+
+	options := NewOptions()
+	options.HeadingAnchors = true
+	input = "# Hi"
+	want = "<h1 id=\"hi\"><a aria-hidden=\"true\" class=\"anchor\" href=\"#hi\">#</a>Hi</h1>\n"
+	if got := renderMarkdown(input, options); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestTableOfContents(t *testing.T) {
+	input := "[TOC]\n\n# A\n\n## B"
+	want := "<nav class=\"toc\"><ul><li><a href=\"#a\">A</a><ul><li><a href=\"#b\">B</a></li></ul></li></ul></nav>\n" +
+		"<h1 id=\"a\">A</h1>\n<h2 id=\"b\">B</h2>\n"
+
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Unclosed openers used to parse the rest of the input again for every opener nested inside them. Eight times the
+// input has to take about eight times as long, and well short of the sixty-four times a quadratic parser would take.
+// The limit leaves room for a noisy machine.
+func TestUnclosedOpenersParseInLinearTime(t *testing.T) {
+	patterns := []string{"[", "![", "x[^a]", "~a[b", "==[^", "^[", "[~", "~~["}
+
+	for _, pattern := range patterns {
+		short := parseTime(strings.Repeat(pattern, 500))
+		long := parseTime(strings.Repeat(pattern, 4000))
+
+		if long > time.Second {
+			t.Errorf("%q repeated 4000 times took %v", pattern, long)
+		}
+		if long > 24*short {
+			t.Errorf("%q took %v repeated 500 times but %v repeated 4000 times", pattern, short, long)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Every closer used to search back through every opener, and every pair rebuilt the whole list of nodes. Eight
+// times the input may take at most twenty-four times as long, which a quadratic parser cannot manage.
+func TestEmphasisParsesInLinearTime(t *testing.T) {
+	patterns := []string{"a*a ", "a* ", "*a ", "_a_ ", "**a* ", "a**b*c "}
+
+	for _, pattern := range patterns {
+		short := parseTime(strings.Repeat(pattern, 2500))
+		long := parseTime(strings.Repeat(pattern, 20000))
+
+		if long > time.Second {
+			t.Errorf("%q repeated 20000 times took %v", pattern, long)
+		}
+		if long > 24*short {
+			t.Errorf("%q took %v repeated 2500 times but %v repeated 20000 times", pattern, short, long)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestUnclosedOpenersStayText(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[[[a", "<p>[[[a</p>\n"},
+		{"~a[b~ c", "<p><sub>a[b</sub> c</p>\n"},
+		{"[a ~~b](/c)", "<p><a href=\"/c\">a ~~b</a></p>\n"},
+		{"==a [b==](/c)", "<p>==a <a href=\"/c\">b==</a></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestListLooseness(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"- a\n- b", "<ul><li>a</li><li>b</li></ul>\n"},
+		{"- a\n\n- b", "<ul><li><p>a</p></li><li><p>b</p></li></ul>\n"},
+		{"- a\n\n  para\n- b", "<ul><li><p>a</p><p>para</p></li><li><p>b</p></li></ul>\n"},
+		{"- a\n- b\n\n  para", "<ul><li><p>a</p></li><li><p>b</p><p>para</p></li></ul>\n"},
+		{"- a\n  - b\n\n    c\n- d", "<ul><li>a<ul><li><p>b</p><p>c</p></li></ul></li><li>d</li></ul>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestTaskListItems(t *testing.T) {
+	input := "- [ ] todo\n- [x] done\n- [X] also done\n- [y] not a task"
+	want := "<ul><li class=\"task-list-item\"><input disabled type=\"checkbox\"> todo</li>" +
+		"<li class=\"task-list-item\"><input checked disabled type=\"checkbox\"> done</li>" +
+		"<li class=\"task-list-item\"><input checked disabled type=\"checkbox\"> also done</li>" +
+		"<li>[y] not a task</li></ul>\n"
+
+	if got := renderMarkdown(input, NewOptions()); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestCountTasks(t *testing.T) {
+	tests := []struct {
+		input     string
+		total     int
+		completed int
+	}{
+		{"- [ ] todo\n- [x] done\n- [X] also done\n- [y] not a task", 3, 2},
+		{"- [ ] outer\n  - [x] inner\n  - plain", 2, 1},
+		{"1. [x] first\n2. [x] second", 2, 2},
+		{"- plain\n\n[ ] not in a list", 0, 0},
+	}
+
+	for _, test := range tests {
+		total, completed := NewDocument(&test.input, NewOptions()).countTasks()
+		if total != test.total || completed != test.completed {
+			t.Errorf("%q counted %v tasks with %v completed, want %v with %v", test.input, total, completed,
+				test.total, test.completed)
+		}
+	}
+
+	input := "- [x] done"
+	options := NewOptions()
+	options.Sanitize = true
+	if total, completed := NewDocument(&input, options).countTasks(); total != 1 || completed != 1 {
+		t.Errorf("%q counted %v tasks with %v completed when sanitized, want 1 with 1", input, total, completed)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestLinksInsideLinks(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"[a [b](/in)](/out)", "<p>[a <a href=\"/in\">b</a>](/out)</p>\n"},
+		{"[a [b](/in)]", "<p>[a <a href=\"/in\">b</a>]</p>\n"},
+		{"[a <https://b.c>](/out)", "<p>[a <a href=\"https://b.c\">https://b.c</a>](/out)</p>\n"},
+		{"[![img](/i.png)](/out)", "<p><a href=\"/out\"><img alt=\"img\" src=\"/i.png\"/></a></p>\n"},
+		{"[a *b*](/out)", "<p><a href=\"/out\">a <i>b</i></a></p>\n"},
+		{"![a [b](/in)](/i.png)", "<p><img alt=\"a b\" src=\"/i.png\"/></p>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestIndentedAtxHeadings(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"# Heading", "<h1 id=\"heading\">Heading</h1>\n"},
+		{"  # Heading", "<h1 id=\"heading\">Heading</h1>\n"},
+		{"   ### Three ###", "<h3 id=\"three\">Three</h3>\n"},
+		{"text\n  ## Next", "<p>text</p>\n<h2 id=\"next\">Next</h2>\n"},
+		{"    # Code", "<pre><code># Code\n</code></pre>\n"},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, NewOptions()); got != test.want {
+			t.Errorf("%q rendered %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
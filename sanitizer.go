@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+// Allowlist based filtering of html, for documents written by people who are not trusted.
+// ----------------------------------------------------------------------------------------------------------------
+
+type HtmlAttribute struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+type HtmlTag struct {
+	name        string
+	closing     bool
+	selfClosing bool
+	attributes  []HtmlAttribute
+}
+
+type Sanitizer struct {
+	tags          map[string][]string
+	dropped       []string
+	urlAttributes []string
+	schemes       []string
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Object creation
+// ----------------------------------------------------------------------------------------------------------------
+
+// Allows the tags the parser produces along with the common formatting tags people write by hand.
+func NewSanitizer(schemes []string) *Sanitizer {
+	return &Sanitizer{
+		tags: map[string][]string{
+			"a": {"href", "name"}, "abbr": {}, "b": {}, "blockquote": {"cite"}, "br": {}, "code": {},
+			"dd": {}, "del": {}, "details": {"open"}, "div": {}, "dl": {}, "dt": {}, "em": {}, "h1": {}, "h2": {},
+			"h3": {}, "h4": {}, "h5": {}, "h6": {}, "hr": {}, "i": {}, "img": {"src", "alt", "width", "height"},
+			"input": {"type", "checked", "disabled"}, "ins": {}, "kbd": {}, "li": {}, "mark": {}, "nav": {},
+			"ol": {"start"}, "p": {}, "pre": {}, "q": {"cite"}, "s": {}, "samp": {}, "section": {}, "small": {},
+			"span": {}, "strong": {}, "sub": {}, "summary": {}, "sup": {}, "table": {}, "tbody": {},
+			"td": {"align", "colspan", "rowspan"}, "tfoot": {}, "th": {"align", "colspan", "rowspan"}, "thead": {},
+			"tr": {}, "u": {}, "ul": {},
+		},
+		dropped:       []string{"iframe", "noscript", "script", "style", "textarea", "title"},
+		urlAttributes: []string{"href", "src", "cite"},
+		schemes:       schemes,
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Scans the tag starting at the < at index, returning nil when there is not a well formed tag there.
+func scanTag(input string, index int) (*HtmlTag, int) {
+	if index >= len(input) || input[index] != '<' {
+		return nil, index
+	}
+	index++
+
+	tag := &HtmlTag{}
+	if index < len(input) && input[index] == '/' {
+		tag.closing = true
+		index++
+	}
+
+	start := index
+	for index < len(input) && (isAlphaNumeric(input[index]) || (index > start && input[index] == '-')) {
+		index++
+	}
+	if index == start || isDigit(input[start]) {
+		return nil, start
+	}
+	tag.name = strings.ToLower(input[start:index])
+
+	for {
+		spaceStart := index
+		index = skipHtmlSpace(input, index)
+
+		switch {
+		case index >= len(input):
+			return nil, start
+		case input[index] == '>':
+			return tag, index + 1
+		case strings.HasPrefix(input[index:], "/>") && !tag.closing:
+			tag.selfClosing = true
+			return tag, index + 2
+		case index == spaceStart || tag.closing:
+			return nil, start
+		}
+
+		attribute, end := scanAttribute(input, index)
+		if attribute == nil {
+			return nil, start
+		}
+		tag.attributes = append(tag.attributes, *attribute)
+		index = end
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func scanAttribute(input string, index int) (*HtmlAttribute, int) {
+	start := index
+	for index < len(input) && (isAlphaNumeric(input[index]) || strings.IndexByte("_:.-", input[index]) != -1) {
+		if index == start && (isDigit(input[index]) || input[index] == '.' || input[index] == '-') {
+			return nil, index
+		}
+		index++
+	}
+	if index == start {
+		return nil, index
+	}
+	attribute := &HtmlAttribute{name: strings.ToLower(input[start:index])}
+
+	valueStart := skipHtmlSpace(input, index)
+	if valueStart >= len(input) || input[valueStart] != '=' {
+		return attribute, index
+	}
+	index = skipHtmlSpace(input, valueStart+1)
+	if index >= len(input) {
+		return nil, index
+	}
+
+	attribute.hasValue = true
+	switch quote := input[index]; quote {
+	case '"', '\'':
+		end := strings.IndexByte(input[index+1:], quote)
+		if end == -1 {
+			return nil, index
+		}
+		attribute.value = input[index+1 : index+1+end]
+		return attribute, index + end + 2
+	default:
+		end := index
+		for end < len(input) && strings.IndexByte(" \t\n\r\f\"'=<>`", input[end]) == -1 {
+			end++
+		}
+		if end == index {
+			return nil, index
+		}
+		attribute.value = input[index:end]
+		return attribute, end
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func skipHtmlSpace(input string, index int) int {
+	for index < len(input) && strings.IndexByte(" \t\n\r\f", input[index]) != -1 {
+		index++
+	}
+	return index
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Relative URLs are always safe. Otherwise the scheme has to be one of the allowed ones. Browsers ignore tabs and
+// newlines inside URLs, so they are removed before the scheme is read.
+func isSafeUrl(url string, schemes []string) bool {
+	url = strings.TrimSpace(url)
+	url = strings.Map(func(ch rune) rune {
+		if ch == '\t' || ch == '\n' || ch == '\r' {
+			return -1
+		}
+		return ch
+	}, url)
+
+	colon := strings.IndexByte(url, ':')
+	if colon == -1 || strings.ContainsAny(url[:colon], "/?#") {
+		return true
+	}
+
+	scheme := strings.ToLower(url[:colon])
+	for _, allowed := range schemes {
+		if scheme == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// Methods
+// ----------------------------------------------------------------------------------------------------------------
+
+// Tags that are not allowed are removed and their text is kept, except for tags like <script> whose text is removed
+// along with them. Comments are removed as well.
+func (s *Sanitizer) sanitize(input string) string {
+	var out bytes.Buffer
+
+	for index := 0; index < len(input); {
+		if input[index] != '<' {
+			out.WriteByte(input[index])
+			index++
+			continue
+		}
+
+		if strings.HasPrefix(input[index:], "<!--") {
+			end := strings.Index(input[index+4:], "-->")
+			if end == -1 {
+				break
+			}
+			index += end + 7
+			continue
+		}
+
+		tag, end := scanTag(input, index)
+		if tag == nil {
+			out.WriteString("&lt;")
+			index++
+			continue
+		}
+
+		index = end
+		if _, ok := s.tags[tag.name]; ok {
+			out.WriteString(s.tagToHtml(tag))
+		} else if !tag.closing && s.dropsContent(tag.name) {
+			index = s.contentEnd(input, index, tag.name)
+		}
+	}
+
+	return out.String()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (s *Sanitizer) tagToHtml(tag *HtmlTag) string {
+	if tag.closing {
+		return fmt.Sprintf("</%v>", tag.name)
+	}
+
+	properties := make(map[string]string)
+	for _, attribute := range tag.attributes {
+		if !s.allowsAttribute(tag.name, attribute.name) {
+			continue
+		}
+
+		value := html.UnescapeString(attribute.value)
+		if s.isUrlAttribute(attribute.name) && !isSafeUrl(value, s.schemes) {
+			continue
+		}
+		properties[attribute.name] = value
+	}
+
+	if tag.selfClosing {
+		return fmt.Sprintf("<%v%v/>", tag.name, attributesToHtml(properties))
+	}
+	return fmt.Sprintf("<%v%v>", tag.name, attributesToHtml(properties))
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Every tag may carry a class, an id or a title as well as its own attributes.
+func (s *Sanitizer) allowsAttribute(tagName, attributeName string) bool {
+	switch attributeName {
+	case "class", "id", "title":
+		return true
+	}
+
+	for _, allowed := range s.tags[tagName] {
+		if allowed == attributeName {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+// Finds the end of the closing tag, or the end of the input when the tag is never closed.
+func (s *Sanitizer) contentEnd(input string, index int, tagName string) int {
+	for index < len(input) {
+		next := strings.IndexByte(input[index:], '<')
+		if next == -1 {
+			break
+		}
+		tag, end := scanTag(input, index+next)
+		if tag != nil && tag.closing && tag.name == tagName {
+			return end
+		}
+		index += next + 1
+	}
+	return len(input)
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (s *Sanitizer) dropsContent(tagName string) bool {
+	for _, name := range s.dropped {
+		if name == tagName {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func (s *Sanitizer) isUrlAttribute(attributeName string) bool {
+	for _, name := range s.urlAttributes {
+		if name == attributeName {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+// SanitizedNode
+// ----------------------------------------------------------------------------------------------------------------
+
+// Filters the html of the node it wraps, which lets a sanitizer sit on top of any part of the tree.
+type SanitizedNode struct {
+	node      HtmlNode
+	sanitizer *Sanitizer
+}
+
+func NewSanitizedNode(node HtmlNode, sanitizer *Sanitizer) *SanitizedNode {
+	return &SanitizedNode{
+		node:      node,
+		sanitizer: sanitizer,
+	}
+}
+
+func (s *SanitizedNode) toHtml() string {
+	return s.sanitizer.sanitize(s.node.toHtml())
+}
+
+func (s *SanitizedNode) toText() string {
+	return s.node.toText()
+}
+
+// ----------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+)
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func safeOptions() *Options {
+	options := NewOptions()
+	options.SafeMode = true
+	return options
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestSafeModeUrls(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"javascript link", "[x](javascript:alert(1))", "<p><a href>x</a></p>\n"},
+		{"mixed case and tab", "[x](<JaVa\tscript:alert(1)>)", "<p><a href>x</a></p>\n"},
+		{"decimal entity", "[x](&#106;avascript:alert(1))", "<p><a href>x</a></p>\n"},
+		{"hex entity", "[x](&#x6A;avascript:alert(1))", "<p><a href>x</a></p>\n"},
+		{"named entity colon", "[x](javascript&colon;alert(1))", "<p><a href>x</a></p>\n"},
+		{"data image", "![i](data:image/png;base64,AAAA)", "<p><img alt=\"i\" src/></p>\n"},
+		{"autolink", "<javascript:alert(1)>", "<p><a href>javascript:alert(1)</a></p>\n"},
+		{"reference definition", "[x][r]\n\n[r]: javascript:alert(1)", "<p><a href>x</a></p>\n"},
+		{"shortcut reference", "[r]\n\n[r]: vbscript:msgbox", "<p><a href>r</a></p>\n"},
+		{
+			"allowed schemes and relative urls",
+			"[a](https://a.b/c) [b](/a:b) [c](mailto:a@b.c) <https://a.b>",
+			"<p><a href=\"https://a.b/c\">a</a> <a href=\"/a:b\">b</a> <a href=\"mailto:a@b.c\">c</a> " +
+				"<a href=\"https://a.b\">https://a.b</a></p>\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := renderMarkdown(test.input, safeOptions()); got != test.want {
+			t.Errorf("%v: %q rendered %q, want %q", test.name, test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestSafeModeRawHtml(t *testing.T) {
+	tests := []struct {
+		input     string
+		stripHtml bool
+		want      string
+	}{
+		{"<script>alert(1)</script>", false, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"Text <img src=x onerror=alert(1)> more", false, "<p>Text &lt;img src=x onerror=alert(1)&gt; more</p>\n"},
+		{"<div onclick=\"x\">\n*hi*\n</div>", false, "<p>&lt;div onclick=&quot;x&quot;&gt;\n*hi*\n&lt;/div&gt;</p>\n"},
+		{"<script>alert(1)</script>", true, ""},
+		{"Text <img src=x onerror=alert(1)> more", true, "<p>Text  more</p>\n"},
+	}
+
+	for _, test := range tests {
+		options := safeOptions()
+		options.StripHtml = test.stripHtml
+		if got := renderMarkdown(test.input, options); got != test.want {
+			t.Errorf("%q with StripHtml %v rendered %q, want %q", test.input, test.stripHtml, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestSanitizer(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`<p onclick="x" class=a>hi</p>`, `<p class="a">hi</p>`},
+		{`<script>alert(1)</script>ok`, `ok`},
+		{`<SCRIPT>x</SCRIPT>y`, `y`},
+		{`<style>p{}</style><iframe src=x></iframe><b>b</b>`, `<b>b</b>`},
+		{`<a href="javascript:x" title='t'>l</a>`, `<a title="t">l</a>`},
+		{`<a href="&#106;avascript:x">l</a>`, `<a>l</a>`},
+		{`<img src="data:text/html,x" alt="a&amp;b"/>`, `<img alt="a&amp;b"/>`},
+		{`<!-- c -->1 < 2`, `1 &lt; 2`},
+		{`<marquee>text</marquee>`, `text`},
+	}
+
+	sanitizer := NewSanitizer(NewOptions().SafeSchemes)
+	for _, test := range tests {
+		if got := sanitizer.sanitize(test.input); got != test.want {
+			t.Errorf("%q sanitized to %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestSanitizedDocument(t *testing.T) {
+	input := "<div onclick=x><script>x</script>*a*</div>\n\n[l](javascript:x)"
+	options := NewOptions()
+	options.Sanitize = true
+
+	want := "<div>*a*</div>\n<p><a>l</a></p>\n"
+	if got := renderMarkdown(input, options); got != want {
+		t.Errorf("%q rendered %q, want %q", input, got, want)
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+func TestIsSafeUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com", true},
+		{"MAILTO:a@b.c", true},
+		{"/relative/path:with-colon", true},
+		{"page?q=a:b", true},
+		{"#section", true},
+		{"javascript:alert(1)", false},
+		{" JaVa\tScRiPt:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"data:text/html;base64,AAAA", false},
+		{"vbscript:msgbox", false},
+	}
+
+	schemes := NewOptions().SafeSchemes
+	for _, test := range tests {
+		if got := isSafeUrl(test.url, schemes); got != test.want {
+			t.Errorf("isSafeUrl(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------------------------